@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/customerio/homework/config"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/progress"
+	"github.com/customerio/homework/report"
+	"github.com/customerio/homework/storage"
+	"github.com/customerio/homework/stream"
+	"github.com/customerio/homework/user_history"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// command is selected by the first program argument, its flags come before
+// its positional args
+type command struct {
+	usage   string
+	summary string
+	minArgs int
+	maxArgs int
+	// defines the command's flags, nil for none
+	flags func(flags *flag.FlagSet)
+	// config settings the command also takes as flags, along with -config
+	settings []string
+	run      func(args []string) error
+}
+
+// settings of the commands working on the state alone, forgotten users
+// included
+var stateSettings = []string{"state-dir", "tombstones"}
+
+var commands = map[string]command{
+	"run": {
+		usage:    "run [flags] [input file | 1 | 2 | 3]",
+		summary:  "ingest an input file and write the report, checking it against the verification file",
+		minArgs:  0,
+		maxArgs:  1,
+		flags:    addRunFlags,
+		settings: config.Names(),
+		run:      runReport,
+	},
+	"generate": {
+		usage:    "generate [flags]",
+		summary:  "write the report again from the state kept by run -keep-state, reading no input",
+		minArgs:  0,
+		maxArgs:  0,
+		flags:    addGenerateFlags,
+		settings: []string{"state-dir", "tombstones", "output", "format", "disk-budget", "checkpoint-interval", "progress-interval"},
+		run:      generateReport,
+	},
+	"validate": {
+		usage:   "validate <report> <verification file>",
+		summary: "check a summary report line by line against a verification file",
+		minArgs: 2,
+		maxArgs: 2,
+		run:     validateReportFile,
+	},
+	"diff": {
+		usage:   "diff [flags] <report> <expected report>",
+		summary: "compare two summary reports user by user, listing every difference",
+		minArgs: 2,
+		maxArgs: 2,
+		flags:   addDiffFlags,
+		run:     diffReports,
+	},
+	"inspect": {
+		usage:    "inspect <user_id>",
+		summary:  "print the state of a user as JSON",
+		minArgs:  1,
+		maxArgs:  1,
+		settings: stateSettings,
+		run:      inspectUser,
+	},
+	"status": {
+		usage:    "status [flags]",
+		summary:  "show what the state directory holds: an interrupted run, ingest progress, users",
+		minArgs:  0,
+		maxArgs:  0,
+		flags:    addStatusFlags,
+		settings: stateSettings,
+		run:      showStatus,
+	},
+	"reset": {
+		usage:    "reset",
+		summary:  "remove all user state, ingest progress and report checkpoints",
+		minArgs:  0,
+		maxArgs:  0,
+		settings: stateSettings,
+		run:      resetState,
+	},
+	"export": {
+		usage:    "export <snapshot file>",
+		summary:  "write the state to a snapshot file",
+		minArgs:  1,
+		maxArgs:  1,
+		settings: stateSettings,
+		run:      exportSnapshot,
+	},
+	"import": {
+		usage:    "import <snapshot file>",
+		summary:  "restore the state from a snapshot file into an empty state directory",
+		minArgs:  1,
+		maxArgs:  1,
+		settings: stateSettings,
+		run:      importSnapshot,
+	},
+	"migrate": {
+		usage:    "migrate",
+		summary:  "rewrite every user state in the current state version",
+		minArgs:  0,
+		maxArgs:  0,
+		settings: stateSettings,
+		run:      migrateState,
+	},
+	"fsck": {
+		usage:    "fsck [flags] [input file to replay when repairing]",
+		summary:  "report corrupt and orphaned state, repairing it when given the input file",
+		minArgs:  0,
+		maxArgs:  1,
+		flags:    addFsckFlags,
+		settings: stateSettings,
+		run:      checkState,
+	},
+	"history": {
+		usage:    "history [flags] <user_id> [attribute]",
+		summary:  "print the attribute values kept for a user, or the values they had at a time",
+		minArgs:  1,
+		maxArgs:  2,
+		flags:    addHistoryFlags,
+		settings: stateSettings,
+		run:      showAttributeHistory,
+	},
+	"export-history": {
+		usage:    "export-history <ndjson file>",
+		summary:  "write the attribute values kept for every user as JSON lines",
+		minArgs:  1,
+		maxArgs:  1,
+		settings: stateSettings,
+		run:      exportAttributeHistory,
+	},
+	"forget": {
+		usage:    "forget <user_id>",
+		summary:  "remove a user's state and keep them out of later runs",
+		minArgs:  1,
+		maxArgs:  1,
+		settings: []string{"state-dir", "tombstones", "audit-log"},
+		run:      forgetUser,
+	},
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n", os.Args[0])
+	fmt.Fprintf(w, "       %s [run flags] <1 | 2 | 3>\n\ncommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].summary)
+	}
+	_ = tw.Flush()
+	fmt.Fprintf(w, "\nrun %s <command> -h for the flags of a command\n", os.Args[0])
+}
+
+func runCommand(name string, args []string) error {
+	cmd := commands[name]
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	configFile := ""
+	if len(cmd.settings) > 0 {
+		config.AddFlags(flags, cmd.settings...)
+		flags.StringVar(&configFile, "config", "", "JSON config file of settings, or "+config.FileEnv)
+	}
+	printCommandUsage := func(w io.Writer) {
+		fmt.Fprintf(w, "usage: %s %s\n\n%s\n", os.Args[0], cmd.usage, cmd.summary)
+		flags.SetOutput(w)
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		printCommandUsage(os.Stdout)
+		return err
+	} else if err != nil {
+		printCommandUsage(os.Stderr)
+		return usageErrorf("%s: %v", name, err)
+	}
+
+	if flags.NArg() < cmd.minArgs || flags.NArg() > cmd.maxArgs {
+		printCommandUsage(os.Stderr)
+		return usageErrorf("incorrect num of args!  usage: %s", cmd.usage)
+	}
+	if len(cmd.settings) > 0 {
+		cfg, err := loadConfig(configFile, flags)
+		if err != nil {
+			return usageErrorf("invalid config: %v", err)
+		}
+		cfg.Apply()
+		log.Printf("config: %s", cfg)
+	}
+
+	return cmd.run(flags.Args())
+}
+
+// loadConfig layers the config file, the environment and the flags given over the defaults
+func loadConfig(configFile string, flags *flag.FlagSet) (*config.Config, error) {
+	cfg := config.Default()
+
+	if configFile == "" {
+		configFile = os.Getenv(config.FileEnv)
+	}
+	if configFile != "" {
+		err := cfg.LoadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cfg.LoadEnv(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.LoadFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+var runIngestFlags *ingestFlags
+var runReportFlags *reportFlags
+
+func addRunFlags(flags *flag.FlagSet) {
+	runIngestFlags = addIngestFlags(flags)
+	runReportFlags = addReportFlags(flags)
+}
+
+func runReport(args []string) error {
+	verifyFile, err := runIngestFlags.apply(args)
+	if err != nil {
+		return err
+	}
+	err = runReportFlags.apply()
+	if err != nil {
+		return err
+	}
+
+	err = writeReport(true)
+	if err != nil {
+		return err
+	}
+
+	return validateReport(verifyFile)
+}
+
+var generateReportFlags *reportFlags
+
+func addGenerateFlags(flags *flag.FlagSet) {
+	generateReportFlags = addReportFlags(flags)
+}
+
+// generateReport reports the state as kept, which it keeps for the next run
+func generateReport(_ []string) error {
+	global.Strategy = "storage"
+	global.UseStorage = true
+	global.KeepState = true
+	err := generateReportFlags.apply()
+	if err != nil {
+		return err
+	}
+
+	err = writeReport(false)
+	if err != nil {
+		return err
+	}
+
+	log.Println("SUCCESS")
+	return nil
+}
+
+func validateReportFile(args []string) error {
+	err := validate(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	log.Println("SUCCESS")
+	return nil
+}
+
+func inspectUser(args []string) error {
+	userId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return usageErrorf("invalid user_id %q", args[0])
+	}
+
+	user, err := storage.LoadExistingUserState(userId)
+	if err != nil {
+		return err
+	}
+
+	byteArray, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(byteArray))
+	return nil
+}
+
+var statusJson *bool
+
+func addStatusFlags(flags *flag.FlagSet) {
+	statusJson = flags.Bool("json", false, "write the status as JSON")
+}
+
+func showStatus(_ []string) error {
+	status, err := storage.LoadStatus()
+	if err != nil {
+		return err
+	}
+
+	if *statusJson {
+		byteArray, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(byteArray))
+		return nil
+	}
+
+	fmt.Printf("state directory: %s\n", status.StateDirectory)
+	fmt.Printf("interrupted:     %t\n", status.Interrupted)
+	switch {
+	case status.IngestInProgress:
+		fmt.Printf("ingest:          stopped at offset %d, %d records read, %d rejected, %d duplicates\n",
+			status.IngestOffset, status.Ingest.Records, status.Ingest.Rejected, status.Ingest.Duplicates)
+	case status.Ingest != nil:
+		fmt.Printf("ingest:          finished, %d records read, %d rejected, %d duplicates\n",
+			status.Ingest.Records, status.Ingest.Rejected, status.Ingest.Duplicates)
+	default:
+		fmt.Println("ingest:          none")
+	}
+	if status.Settings != nil {
+		byteArray, err := json.Marshal(status.Settings)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("settings:        %s\n", byteArray)
+	}
+	fmt.Printf("last report:     generation %d, last full report %s\n",
+		status.Generations.LastGeneration, status.Generations.BaseReport)
+	fmt.Printf("users:           %d\n", status.Users)
+	if status.Progress != nil {
+		fmt.Printf("progress:        %s, updated %s by pid %d\n", progress.Line(status.Progress),
+			time.Unix(status.Progress.UpdatedAt, 0).Format(time.RFC3339), status.Progress.Pid)
+		fmt.Printf("progress file:   %s\n", storage.ProgressFilePath())
+	}
+
+	return nil
+}
+
+func resetState(_ []string) error {
+	err := storage.ClearTempStorage()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("cleared %s", storage.StateDirectory())
+	return nil
+}
+
+func exportSnapshot(args []string) error {
+	header, err := storage.ExportSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("exported %d state files to %s", header.Entries, args[0])
+	return nil
+}
+
+func importSnapshot(args []string) error {
+	header, err := storage.ImportSnapshot(args[0])
+	if err != nil {
+		return err
+	}
+
+	created := time.Unix(header.CreatedAt, 0).UTC().Format(time.RFC3339)
+	log.Printf("imported %d state files from %s (created %s, input %s)",
+		header.Entries, args[0], created, header.InputFilePath)
+	return nil
+}
+
+func migrateState(_ []string) error {
+	result, err := storage.MigrateAllUserStates()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrated %d users to state version %d, %d already current, %d failed",
+		result.Migrated, storage.CurrentStateVersion, result.Current, result.Failed)
+	if result.Failed > 0 {
+		return fmt.Errorf("%d users could not be migrated", result.Failed)
+	}
+
+	return nil
+}
+
+var fsckForce *bool
+
+func addFsckFlags(flags *flag.FlagSet) {
+	fsckForce = flags.Bool("force", false,
+		"rebuild corrupt users from the input file even when the state was built from more than one input")
+}
+
+// checkState reports corrupt and orphaned state.  Given the input file it also
+// repairs, removing orphans and rebuilding corrupt users from the input
+func checkState(args []string) error {
+	result, err := storage.CheckState()
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range result.Corrupt {
+		log.Printf("corrupt: %s (userId %d): %s", issue.Path, issue.UserId, issue.Reason)
+	}
+	for _, issue := range result.Orphaned {
+		log.Printf("orphaned: %s: %s", issue.Path, issue.Reason)
+	}
+	log.Printf("checked %d files, %d corrupt, %d orphaned", result.Checked, len(result.Corrupt), len(result.Orphaned))
+
+	if len(args) == 0 {
+		if len(result.Corrupt) > 0 || len(result.Orphaned) > 0 {
+			return fmt.Errorf("state directory has problems, rerun with the input file to repair")
+		}
+		return nil
+	}
+
+	err = storage.RemoveOrphans(result)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Corrupt) == 0 {
+		return nil
+	}
+
+	global.InputFilePath = args[0]
+	recordStream, err := stream.GetRecords(context.Background())
+	if err != nil {
+		return err
+	}
+
+	rebuilt, err := user_history.RebuildUsers(recordStream, result.CorruptUserIds(), *fsckForce)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("rebuilt %d of %d corrupt users from %s", rebuilt, len(result.Corrupt), args[0])
+	return nil
+}
+
+func forgetUser(args []string) error {
+	userId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return usageErrorf("invalid user_id %q", args[0])
+	}
+
+	entry, err := storage.ForgetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("forgot userId %d (state removed: %t), recorded in %s", userId, entry.StateRemoved, global.AuditLogFilePath)
+	return nil
+}
+
+var historyAt *string
+
+func addHistoryFlags(flags *flag.FlagSet) {
+	historyAt = flags.String("at", "",
+		"print the value each attribute had at this unix time or RFC3339 timestamp, and when it was set")
+}
+
+func showAttributeHistory(args []string) error {
+	userId, err := strconv.Atoi(args[0])
+	if err != nil {
+		return usageErrorf("invalid user_id %q", args[0])
+	}
+
+	var at int64
+	if *historyAt != "" {
+		at, err = parseAsOf(*historyAt)
+		if err != nil {
+			return usageErrorf("invalid -at: %v", err)
+		}
+	}
+
+	user, err := storage.LoadExistingUserState(userId)
+	if err != nil {
+		return err
+	}
+
+	if *historyAt != "" {
+		return showAttributesAt(user, args[1:], at)
+	}
+
+	for _, entry := range storage.AttributeHistory(user) {
+		if len(args) == 2 && entry.Attribute != args[1] {
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n",
+			entry.Attribute, time.Unix(entry.Timestamp, 0).UTC().Format(time.RFC3339), entry.Value)
+	}
+
+	return nil
+}
+
+// showAttributesAt prints the values the named attributes, or all of them,
+// had at a time
+func showAttributesAt(user *models.User, names []string, at int64) error {
+	if len(names) == 0 {
+		names = user_history.SortAttributes(user.Attributes)
+	}
+
+	for _, name := range names {
+		attribute, ok := user.Attributes[name]
+		if !ok {
+			return fmt.Errorf("userId %d has no attribute %q", user.ID, name)
+		}
+
+		value, ok := user_history.ValueAt(attribute, at)
+		if !ok {
+			log.Printf("%s: not set yet at %s, or older than the history kept",
+				name, time.Unix(at, 0).UTC().Format(time.RFC3339))
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", name, time.Unix(value.Timestamp, 0).UTC().Format(time.RFC3339), value.Value)
+	}
+
+	return nil
+}
+
+func exportAttributeHistory(args []string) error {
+	exported, err := storage.ExportAttributeHistory(args[0])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("exported %d attribute values to %s", exported, args[0])
+	return nil
+}
+
+var diffJson *bool
+var diffLimit *int
+
+func addDiffFlags(flags *flag.FlagSet) {
+	diffJson = flags.Bool("json", false, "write the differences as JSON")
+	diffLimit = flags.Int("limit", 100, "users listed per kind of difference, counts always cover every user")
+}
+
+// diffReports compares two summary reports user by user, failing when they differ
+func diffReports(args []string) error {
+	diff, err := report.DiffSummaryReports(args[0], args[1], *diffLimit)
+	if err != nil {
+		return err
+	}
+
+	if *diffJson {
+		byteArray, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(byteArray))
+	} else {
+		fmt.Print(string(diff.Text()))
+	}
+
+	if !diff.Equal() {
+		return fmt.Errorf("%w: reports differ, %d users mismatched, %d missing, %d extra",
+			errMismatch, diff.UsersMismatched, diff.UsersMissing, diff.UsersExtra)
+	}
+
+	return nil
+}
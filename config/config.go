@@ -0,0 +1,372 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/report"
+	"github.com/customerio/homework/storage"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the environment variable of every setting, state-dir is
+// HOMEWORK_STATE_DIR
+const EnvPrefix = "HOMEWORK_"
+
+// FileEnv names a config file when -config isn't given
+const FileEnv = EnvPrefix + "CONFIG"
+
+// Config holds the runtime settings.  Each comes from, in increasing order of
+// precedence, its default, a JSON config file, the environment and a flag
+type Config struct {
+	Strategy           string
+	StateDirectory     string
+	SpillDirectory     string
+	Output             string
+	Tombstones         string
+	AuditLog           string
+	Format             string
+	MemoryBudgetBytes  int64
+	DiskBudgetBytes    int64
+	CheckpointInterval int
+	ProgressInterval   time.Duration
+
+	// where each setting came from, by name
+	sources map[string]string
+}
+
+// setting is known by the same name as a flag and a config file key
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+	get   func(c *Config) string
+}
+
+var settings = []setting{
+	{
+		name:  "strategy",
+		usage: "memory keeps every user in memory, storage saves user state to the state directory, auto picks one from a sample of the input",
+		set: func(c *Config, value string) error {
+			c.Strategy = value
+			return nil
+		},
+		get: func(c *Config) string { return c.Strategy },
+	},
+	{
+		name:  "state-dir",
+		usage: "directory user state is kept in",
+		set: func(c *Config, value string) error {
+			c.StateDirectory = value
+			return nil
+		},
+		get: func(c *Config) string { return c.StateDirectory },
+	},
+	{
+		name:  "spill-dir",
+		usage: "directory an in-memory run spills users over its memory budget to",
+		set: func(c *Config, value string) error {
+			c.SpillDirectory = value
+			return nil
+		},
+		get: func(c *Config) string { return c.SpillDirectory },
+	},
+	{
+		name:  "output",
+		usage: "report file, parts of a split report are numbered next to it",
+		set: func(c *Config, value string) error {
+			c.Output = value
+			return nil
+		},
+		get: func(c *Config) string { return c.Output },
+	},
+	{
+		name:  "tombstones",
+		usage: "file of forgotten users, kept when the state directory is cleared",
+		set: func(c *Config, value string) error {
+			c.Tombstones = value
+			return nil
+		},
+		get: func(c *Config) string { return c.Tombstones },
+	},
+	{
+		name:  "audit-log",
+		usage: "file every forgotten user is recorded in",
+		set: func(c *Config, value string) error {
+			c.AuditLog = value
+			return nil
+		},
+		get: func(c *Config) string { return c.AuditLog },
+	},
+	{
+		name:  "format",
+		usage: "report output format, one of: " + strings.Join(report.FormatNames(), ", "),
+		set: func(c *Config, value string) error {
+			c.Format = value
+			return nil
+		},
+		get: func(c *Config) string { return c.Format },
+	},
+	{
+		name:  "memory-budget",
+		usage: "RAM the run may use, in bytes or with a unit such as 1GiB",
+		set: func(c *Config, value string) (err error) {
+			c.MemoryBudgetBytes, err = storage.ParseBytes(value)
+			return err
+		},
+		get: func(c *Config) string { return storage.FormatBytes(c.MemoryBudgetBytes) },
+	},
+	{
+		name:  "disk-budget",
+		usage: "bytes of state, checkpoints and report allowed on disk, or with a unit such as 10GiB, 0 for no limit",
+		set: func(c *Config, value string) (err error) {
+			c.DiskBudgetBytes, err = storage.ParseBytes(value)
+			return err
+		},
+		get: func(c *Config) string { return storage.FormatBytes(c.DiskBudgetBytes) },
+	},
+	{
+		name:  "checkpoint-interval",
+		usage: "users written between durable report checkpoints",
+		set: func(c *Config, value string) (err error) {
+			c.CheckpointInterval, err = strconv.Atoi(value)
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(c.CheckpointInterval) },
+	},
+	{
+		name:  "progress-interval",
+		usage: "time between progress lines on stderr and updates of the progress file, such as 10s, 0 for none",
+		set: func(c *Config, value string) (err error) {
+			c.ProgressInterval, err = time.ParseDuration(value)
+			return err
+		},
+		get: func(c *Config) string { return c.ProgressInterval.String() },
+	},
+}
+
+func findSetting(name string) (*setting, bool) {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Names lists every setting
+func Names() []string {
+	names := make([]string, len(settings))
+	for i, s := range settings {
+		names[i] = s.name
+	}
+
+	return names
+}
+
+// Default is the configuration the program is built with
+func Default() *Config {
+	c := &Config{
+		Strategy:           global.Strategy,
+		StateDirectory:     storage.StateDirectory(),
+		SpillDirectory:     storage.SpillDirectory(),
+		Output:             global.ReportFilePath,
+		Tombstones:         global.TombstoneFilePath,
+		AuditLog:           global.AuditLogFilePath,
+		Format:             global.ReportFormat,
+		MemoryBudgetBytes:  global.MemoryBudgetBytes,
+		DiskBudgetBytes:    global.DiskBudgetBytes,
+		CheckpointInterval: global.ReportCheckpointInterval,
+		ProgressInterval:   global.ProgressInterval,
+		sources:            map[string]string{},
+	}
+
+	return c
+}
+
+// Set sets the named setting from its text form, noting its source
+func (c *Config) Set(name, value, source string) error {
+	s, ok := findSetting(name)
+	if !ok {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+
+	err := s.set(c, value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q from %s: %w", name, value, source, err)
+	}
+	c.sources[name] = source
+
+	return nil
+}
+
+// LoadFile reads settings from a JSON object such as
+// {"strategy": "storage", "disk-budget": "10GiB", "checkpoint-interval": 500}
+func (c *Config) LoadFile(path string) error {
+	byteArray, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	err = json.Unmarshal(byteArray, &values)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	//in a fixed order so the first bad setting is always the one reported
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var value string
+		switch v := values[name].(type) {
+		case string:
+			value = v
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("invalid config file %s: %s must be a string or a number", path, name)
+		}
+
+		err = c.Set(name, value, "file")
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// LoadEnv reads the settings set in the environment
+func (c *Config) LoadEnv(lookup func(key string) (string, bool)) error {
+	for _, s := range settings {
+		value, ok := lookup(EnvName(s.name))
+		if !ok {
+			continue
+		}
+
+		err := c.Set(s.name, value, "env")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnvName is the environment variable of a setting
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// AddFlags defines a flag for each named setting.  Only flags given on the
+// command line override the file and environment, see LoadFlags
+func AddFlags(flags *flag.FlagSet, names ...string) {
+	defaults := Default()
+	for _, name := range names {
+		s, ok := findSetting(name)
+		if !ok {
+			panic("unknown setting " + name)
+		}
+		flags.String(name, s.get(defaults), s.usage+", or "+EnvName(name))
+	}
+}
+
+// LoadFlags reads the settings given as flags
+func (c *Config) LoadFlags(flags *flag.FlagSet) error {
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if _, ok := findSetting(f.Name); ok && err == nil {
+			err = c.Set(f.Name, f.Value.String(), "flag")
+		}
+	})
+
+	return err
+}
+
+// Validate checks the settings make sense together
+func (c *Config) Validate() error {
+	if c.Strategy != "memory" && c.Strategy != "storage" && c.Strategy != "auto" {
+		return fmt.Errorf("unknown strategy %q, expected memory, storage or auto", c.Strategy)
+	}
+	if c.StateDirectory == "" {
+		return fmt.Errorf("state-dir can't be empty")
+	}
+	if c.SpillDirectory == "" {
+		return fmt.Errorf("spill-dir can't be empty")
+	}
+	if c.Output == "" {
+		return fmt.Errorf("output can't be empty")
+	}
+	if c.Tombstones == "" || c.AuditLog == "" {
+		return fmt.Errorf("tombstones and audit-log can't be empty")
+	}
+
+	known := false
+	for _, name := range report.FormatNames() {
+		known = known || name == c.Format
+	}
+	if !known {
+		return fmt.Errorf("unknown format %q, expected one of: %s", c.Format, strings.Join(report.FormatNames(), ", "))
+	}
+
+	if c.MemoryBudgetBytes <= 0 {
+		return fmt.Errorf("memory-budget must be more than 0")
+	}
+	if c.DiskBudgetBytes < 0 {
+		return fmt.Errorf("disk-budget can't be negative")
+	}
+	if c.CheckpointInterval <= 0 {
+		return fmt.Errorf("checkpoint-interval must be more than 0")
+	}
+	if c.ProgressInterval < 0 {
+		return fmt.Errorf("progress-interval can't be negative")
+	}
+
+	return nil
+}
+
+// Apply makes the settings the ones the program runs with
+func (c *Config) Apply() {
+	global.Strategy = c.Strategy
+	global.UseStorage = c.Strategy == "storage"
+	storage.SetStateDirectory(c.StateDirectory)
+	storage.SetSpillDirectory(c.SpillDirectory)
+	global.ReportFilePath = c.Output
+	//statistics and segments go with the report
+	global.StatsFilePath = filepath.Join(filepath.Dir(c.Output), "stats.txt")
+	global.StatsJsonFilePath = filepath.Join(filepath.Dir(c.Output), "stats.json")
+	global.SegmentsDirectory = filepath.Join(filepath.Dir(c.Output), "segments")
+	global.TombstoneFilePath = c.Tombstones
+	global.AuditLogFilePath = c.AuditLog
+	global.ReportFormat = c.Format
+	global.MemoryBudgetBytes = c.MemoryBudgetBytes
+	global.DiskBudgetBytes = c.DiskBudgetBytes
+	global.ReportCheckpointInterval = c.CheckpointInterval
+	global.ProgressInterval = c.ProgressInterval
+}
+
+// String is the effective configuration with where each setting came from
+func (c *Config) String() string {
+	parts := make([]string, len(settings))
+	for i, s := range settings {
+		source, ok := c.sources[s.name]
+		if !ok {
+			source = "default"
+		}
+		parts[i] = fmt.Sprintf("%s=%s (%s)", s.name, s.get(c), source)
+	}
+
+	return strings.Join(parts, " ")
+}
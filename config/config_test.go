@@ -0,0 +1,155 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func lookupIn(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+// loadTestConfig loads the file, environment and command line in the order
+// the commands do
+func loadTestConfig(t *testing.T, file string, env map[string]string, args ...string) *Config {
+	t.Helper()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	AddFlags(flags, Names()...)
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Default()
+	if file != "" {
+		err = c.LoadFile(writeConfigFile(t, file))
+		if err != nil {
+			t.Fatalf("LoadFile: %v", err)
+		}
+	}
+	err = c.LoadEnv(lookupIn(env))
+	if err != nil {
+		t.Fatalf("LoadEnv: %v", err)
+	}
+	err = c.LoadFlags(flags)
+	if err != nil {
+		t.Fatalf("LoadFlags: %v", err)
+	}
+
+	return c
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := `{"strategy": "storage", "format": "csv", "checkpoint-interval": 500, "disk-budget": "2GiB"}`
+	env := map[string]string{
+		"HOMEWORK_FORMAT":              "ndjson",
+		"HOMEWORK_CHECKPOINT_INTERVAL": "250",
+	}
+
+	c := loadTestConfig(t, file, env, "-checkpoint-interval", "100")
+
+	if c.Strategy != "storage" || c.DiskBudgetBytes != 2<<30 {
+		t.Errorf("file settings = %s, %d", c.Strategy, c.DiskBudgetBytes)
+	}
+	if c.Format != "ndjson" {
+		t.Errorf("format = %s, the environment overrides the file", c.Format)
+	}
+	if c.CheckpointInterval != 100 {
+		t.Errorf("checkpoint-interval = %d, a flag overrides the environment", c.CheckpointInterval)
+	}
+	if c.Output != Default().Output {
+		t.Errorf("output = %s, want the default", c.Output)
+	}
+
+	described := c.String()
+	for _, want := range []string{
+		"strategy=storage (file)", "format=ndjson (env)", "checkpoint-interval=100 (flag)", "output=data/output.txt (default)",
+	} {
+		if !strings.Contains(described, want) {
+			t.Errorf("String() = %s, missing %s", described, want)
+		}
+	}
+}
+
+func TestConfigFlagsAtTheirDefault(t *testing.T) {
+	//a flag left out doesn't put back the default over the environment
+	c := loadTestConfig(t, "", map[string]string{"HOMEWORK_OUTPUT": "report.txt"}, "-format", "csv")
+	if c.Output != "report.txt" || c.Format != "csv" {
+		t.Errorf("output = %s, format = %s", c.Output, c.Format)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{"unknown file setting", `{"colour": "blue"}`, nil},
+		{"file value of the wrong type", `{"strategy": ["storage"]}`, nil},
+		{"bad file value", `{"memory-budget": "lots"}`, nil},
+		{"bad environment value", "", map[string]string{"HOMEWORK_CHECKPOINT_INTERVAL": "often"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := Default()
+			var err error
+			if test.file != "" {
+				err = c.LoadFile(writeConfigFile(t, test.file))
+			}
+			if err == nil {
+				err = c.LoadEnv(lookupIn(test.env))
+			}
+			if err == nil {
+				t.Errorf("loaded without an error")
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+	}{
+		{"strategy", func(c *Config) { c.Strategy = "cloud" }},
+		{"format", func(c *Config) { c.Format = "xml" }},
+		{"state-dir", func(c *Config) { c.StateDirectory = "" }},
+		{"memory-budget", func(c *Config) { c.MemoryBudgetBytes = 0 }},
+		{"disk-budget", func(c *Config) { c.DiskBudgetBytes = -1 }},
+		{"checkpoint-interval", func(c *Config) { c.CheckpointInterval = 0 }},
+		{"progress-interval", func(c *Config) { c.ProgressInterval = -time.Second }},
+	}
+
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("default config invalid: %v", err)
+	}
+	for _, test := range tests {
+		c := Default()
+		test.change(c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("invalid %s passed validation", test.name)
+		}
+	}
+}
@@ -29,3 +29,8 @@ func (e *Error) getCause() string {
 
 	return ""
 }
+
+// Unwrap exposes the cause to errors.Is and errors.As
+func (e *Error) Unwrap() error {
+	return e.err
+}
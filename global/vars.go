@@ -1,7 +1,91 @@
 package global
 
-const UseStorage = false
-const ReportFilePath = "data/output.txt"
+import "time"
+
+// memory, storage or auto, which picks one of them from the input and the
+// memory budget and sets UseStorage accordingly
+var Strategy = "auto"
+
+// save user state to disk instead of keeping every user in memory
+var UseStorage = false
+
+var ReportFilePath = "data/output.txt"
+
+// forgotten users, kept outside temp storage so they survive ClearTempStorage
+var TombstoneFilePath = "data/tombstones"
+var AuditLogFilePath = "data/audit.log"
+
+// dataset statistics written alongside the report
+var StatsFilePath = "data/stats.txt"
+var StatsJsonFilePath = "data/stats.json"
+
+// a membership file of user ids per segment is written here, next to the report
+var SegmentsDirectory = "data/segments"
+
+// most active users listed in the statistics
+var StatsTopUsers = 10
+
+// RAM the run may use
+var MemoryBudgetBytes int64 = 1024 * 1024 * 1024
+
+// total bytes of state, checkpoints and report allowed on disk
+var DiskBudgetBytes int64 = 10 * 1024 * 1024 * 1024
+
+// time between progress lines and updates of the progress file, 0 for none
+var ProgressInterval = 5 * time.Second
+
+// users written between durable report checkpoints
+var ReportCheckpointInterval = 1000
+
+// split the report into part files of at most this many users, 0 for one file
+var ReportPartUsers = 0
+
+// split the report into part files once they reach this many bytes, 0 for one file
+var ReportPartBytes int64 = 0
+
+// name of the report.Formatter used to write the report
+var ReportFormat = "summary"
+
+// text/template file executed per user by the "template" report format
+var ReportTemplatePath string
+
+// JSON file selecting, ordering and renaming report fields
+var ReportProjectionPath string
+
+// keep user state after a successful run so later inputs are ingested into it
+var KeepState = false
+
+// write only the users changed since the last report, requires KeepState
+var DeltaReport = false
+
+// day, week or month to also count events per time bucket and report the
+// series instead of totals, "" for totals only
+var EventBuckets = ""
+
+// timezone bucket boundaries are in
+var EventTimezone = "UTC"
+
+// aggregations of numeric event data fields, "sum(purchase.price),avg(order.items)"
+var EventAggregations = ""
+
+// unix time of the last records ingested, later records are skipped so the
+// report shows the users as they were then, 0 for all records
+var AsOf int64 = 0
+
+// JSON file of segment definitions evaluated for every user
+var SegmentsFilePath string
+
+// add the segments of each user to the report as a segments column
+var ReportSegmentsColumn = false
+
+// values kept in each attribute's history, -1 for all of them and 0 for none
+var AttributeHistory = 0
+
+// report when attributes were set and users and events first and last seen
+var ReportSeen = false
+
+// report event totals even when events are bucketed
+var ReportEventTotals = false
 
 var WasInterrupted = false
 
@@ -3,67 +3,513 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/customerio/homework/custom_error"
 	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/progress"
 	"github.com/customerio/homework/report"
+	"github.com/customerio/homework/segments"
 	"github.com/customerio/homework/storage"
+	"github.com/customerio/homework/user_history"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const _dataFilePattern = "data/messages.%s.data"
 const _verifyFilePattern = "data/verify.%s.csv"
 
+// exit codes, one per class of failure so scripts can tell them apart
+const (
+	exitOK = 0
+	// the run or command failed
+	exitFailure = 1
+	// unknown command, bad flags or arguments
+	exitUsage = 2
+	// the report doesn't match the verification file, or the reports differ
+	exitMismatch = 3
+	// the state is corrupt, from a newer version, built with other settings or
+	// from more inputs than a repair replays
+	exitState = 4
+	// stopped by a signal, run again to resume
+	exitInterrupted = 5
+	// the disk budget ran out, free space and run again to resume
+	exitDiskBudget = 6
+	// the user asked about has no state
+	exitNotFound = 7
+)
+
+// errMismatch is returned when a report isn't what was expected
+var errMismatch = errors.New("report mismatch")
+
+// usageError is a mistake in how the program was called
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatal(fmt.Sprintf("Incorrect num of args!  Expected: 1 Found: %d", len(os.Args)-1))
+	os.Exit(execute(os.Args[1:]))
+}
+
+func execute(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		if len(args) > 1 {
+			if _, ok := commands[args[1]]; ok {
+				_ = runCommand(args[1], []string{"-h"})
+				return exitOK
+			}
+		}
+		printUsage(os.Stdout)
+		return exitOK
 	}
 
-	if os.Args[1] != "1" && os.Args[1] != "2" && os.Args[1] != "3" {
-		log.Fatal("unknown or invalid argument: " + os.Args[1])
+	if _, ok := commands[name]; ok {
+		args = args[1:]
+	} else if strings.HasPrefix(name, "-") || isDataset(name) {
+		//the original form, [flags] <1|2|3>, runs a dataset
+		name = "run"
+	} else {
+		printUsage(os.Stderr)
+		log.Println("unknown command: " + name)
+		return exitUsage
+	}
+
+	err := runCommand(name, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
 	}
 
-	global.InputFilePath = fmt.Sprintf(_dataFilePattern, os.Args[1])
-	verifyFile := fmt.Sprintf(_verifyFilePattern, os.Args[1])
+	return exitOK
+}
+
+func exitCode(err error) int {
+	var usage *usageError
+	switch {
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, errMismatch):
+		return exitMismatch
+	case errors.Is(err, storage.ErrCorruptState), errors.Is(err, storage.ErrFutureStateVersion),
+		errors.Is(err, storage.ErrIngestSettingsChanged), errors.Is(err, user_history.ErrSeveralInputs):
+		return exitState
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, storage.ErrDiskBudgetExceeded):
+		return exitDiskBudget
+	case errors.Is(err, storage.ErrUserNotFound):
+		return exitNotFound
+	}
+
+	return exitFailure
+}
+
+func isDataset(arg string) bool {
+	return arg == "1" || arg == "2" || arg == "3"
+}
+
+// ingestFlags are the flags of run, which reads an input file into the state
+type ingestFlags struct {
+	input             *string
+	verify            *string
+	eventBuckets      *string
+	eventTimezone     *string
+	eventAggregations *string
+	attributeHistory  *int
+	asOf              *string
+	keepState         *bool
+}
+
+func addIngestFlags(flags *flag.FlagSet) *ingestFlags {
+	return &ingestFlags{
+		input: flags.String("input", "",
+			"input file of JSON records, also given as the argument, where 1, 2 or 3 selects a dataset"),
+		verify: flags.String("verify", "",
+			"verification file the report must match, defaults to the dataset's"),
+		eventBuckets: flags.String("buckets", global.EventBuckets,
+			"also count events per day, week or month and report the series instead of totals"),
+		eventTimezone: flags.String("tz", global.EventTimezone,
+			"timezone of the event bucket boundaries"),
+		eventAggregations: flags.String("aggregate", global.EventAggregations,
+			"comma separated sum, min, max or avg of event data fields, such as sum(purchase.price)"),
+		attributeHistory: flags.Int("attribute-history", global.AttributeHistory,
+			"attribute values kept per user in the state, -1 for all and 0 for none, needs -keep-state"),
+		asOf: flags.String("as-of", "",
+			"report users as they were at this unix time or RFC3339 timestamp, ignoring later records"),
+		keepState: flags.Bool("keep-state", global.KeepState,
+			"keep user state after the run so the next input is ingested into it, storage only"),
+	}
+}
+
+// apply sets the globals from the flags, and args, and returns the verification file
+func (f *ingestFlags) apply(args []string) (string, error) {
+	verifyFile := *f.verify
+	global.InputFilePath = *f.input
+	if len(args) == 1 {
+		if global.InputFilePath != "" {
+			return "", usageErrorf("give the input as -input or as the argument, not both")
+		}
+		global.InputFilePath = args[0]
+		if isDataset(args[0]) {
+			global.InputFilePath = fmt.Sprintf(_dataFilePattern, args[0])
+			if verifyFile == "" {
+				verifyFile = fmt.Sprintf(_verifyFilePattern, args[0])
+			}
+		}
+	}
+	if global.InputFilePath == "" {
+		return "", usageErrorf("no input file, give it as -input or as the argument")
+	}
+
+	global.EventBuckets = *f.eventBuckets
+	global.EventTimezone = *f.eventTimezone
+	global.AttributeHistory = *f.attributeHistory
+	if *f.asOf != "" {
+		var err error
+		global.AsOf, err = parseAsOf(*f.asOf)
+		if err != nil {
+			return "", usageErrorf("invalid -as-of: %v", err)
+		}
+	}
+	if err := user_history.CheckEventBuckets(); err != nil {
+		return "", usageErrorf("invalid event buckets: %v", err)
+	}
+	global.EventAggregations = *f.eventAggregations
+	if err := user_history.CheckEventAggregations(); err != nil {
+		return "", usageErrorf("invalid event aggregations: %v", err)
+	}
+
+	global.KeepState = *f.keepState
+	err := resolveStrategy()
+	if err != nil {
+		return "", err
+	}
+	if global.KeepState && !global.UseStorage {
+		return "", usageErrorf("-keep-state needs -strategy storage or auto")
+	}
+	//the history is only of use kept in the state for history to query
+	if global.AttributeHistory != 0 && !global.KeepState {
+		return "", usageErrorf("-attribute-history needs -keep-state")
+	}
+
+	return verifyFile, nil
+}
+
+// resolveStrategy settles the auto strategy.  State to resume or keep needs
+// storage, otherwise users are kept in memory when their projected footprint
+// fits the memory budget
+func resolveStrategy() error {
+	if global.Strategy != "auto" {
+		return nil
+	}
+
+	switch {
+	case global.KeepState:
+		global.UseStorage = true
+		log.Println("strategy auto chose storage: -keep-state")
+	case storage.WasInterrupted() && storage.CheckRecordOffsetExist():
+		global.UseStorage = true
+		log.Println("strategy auto chose storage: resuming the interrupted ingest in " + storage.StateDirectory())
+	default:
+		estimate, err := user_history.EstimateInput(global.InputFilePath)
+		if err != nil {
+			return custom_error.New("error sampling input for the auto strategy", err)
+		}
+		global.UseStorage = estimate.FootprintBytes > global.MemoryBudgetBytes
+
+		chosen := "memory"
+		if global.UseStorage {
+			chosen = "storage"
+		}
+		log.Printf("strategy auto chose %s: %s, memory budget %s",
+			chosen, estimate, storage.FormatBytes(global.MemoryBudgetBytes))
+	}
+
+	return nil
+}
+
+// reportFlags are the flags of the commands writing a report
+type reportFlags struct {
+	template       *string
+	projection     *string
+	eventTotals    *bool
+	seen           *bool
+	segmentsFile   *string
+	segmentsColumn *bool
+	partUsers      *int
+	partBytes      *int64
+	delta          *bool
+}
+
+func addReportFlags(flags *flag.FlagSet) *reportFlags {
+	return &reportFlags{
+		template: flags.String("template", "",
+			"text/template file executed per user, selects the template format"),
+		projection: flags.String("projection", "",
+			"JSON file selecting, ordering and renaming the report's attributes and events"),
+		eventTotals: flags.Bool("event-totals", global.ReportEventTotals,
+			"report event totals even when events are bucketed"),
+		seen: flags.Bool("seen", global.ReportSeen,
+			"report when attributes were set and when users and events were first and last seen"),
+		segmentsFile: flags.String("segments", "",
+			"JSON file of segment definitions, a membership file per segment is written to segments/ next to the report"),
+		segmentsColumn: flags.Bool("segments-column", global.ReportSegmentsColumn,
+			"add the segments of each user to the report, needs -segments and reserves the name segments"),
+		partUsers: flags.Int("part-users", global.ReportPartUsers,
+			"split the report into numbered part files of at most this many users, listed in a manifest"),
+		partBytes: flags.Int64("part-bytes", global.ReportPartBytes,
+			"split the report into numbered part files of about this many bytes, listed in a manifest"),
+		delta: flags.Bool("delta", global.DeltaReport,
+			"report only users changed since the last report, needs -keep-state"),
+	}
+}
+
+// apply sets the globals from the flags, over the config.  A bad format, template or
+// projection must fail before any state is touched
+func (f *reportFlags) apply() error {
+	global.ReportTemplatePath = *f.template
+	if global.ReportTemplatePath != "" {
+		global.ReportFormat = "template"
+	}
+	global.ReportProjectionPath = *f.projection
+	global.ReportEventTotals = *f.eventTotals
+	global.ReportSeen = *f.seen
+	if _, err := report.NewFormatter(global.ReportFormat); err != nil {
+		return usageErrorf("invalid report format: %v", err)
+	}
+	if global.ReportProjectionPath != "" {
+		if _, err := report.LoadProjection(global.ReportProjectionPath); err != nil {
+			return usageErrorf("invalid report projection: %v", err)
+		}
+	}
+
+	global.SegmentsFilePath = *f.segmentsFile
+	global.ReportSegmentsColumn = *f.segmentsColumn
+	if global.SegmentsFilePath != "" {
+		if _, err := segments.Load(global.SegmentsFilePath); err != nil {
+			return usageErrorf("invalid segments: %v", err)
+		}
+	} else if global.ReportSegmentsColumn {
+		return usageErrorf("-segments-column needs -segments")
+	}
+
+	global.ReportPartUsers = *f.partUsers
+	global.ReportPartBytes = *f.partBytes
+	if global.ReportPartUsers < 0 || global.ReportPartBytes < 0 {
+		return usageErrorf("-part-users and -part-bytes can't be negative")
+	}
+
+	global.DeltaReport = *f.delta
+	if global.DeltaReport && !global.KeepState {
+		return usageErrorf("-delta needs -keep-state")
+	}
+	//a delta is always written as a single file
+	if global.DeltaReport && (global.ReportPartUsers > 0 || global.ReportPartBytes > 0) {
+		return usageErrorf("-delta can't be split with -part-users or -part-bytes")
+	}
+
+	return nil
+}
+
+// writeReport runs report generation, ingesting the input first when asked.
+// A signal stops it with the state left to resume from
+func writeReport(ingest bool) error {
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 	go func() {
-		<-sigs
-		cancel()
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 
 	global.WasInterrupted = storage.WasInterrupted()
 	_ = storage.CreateInterruptedMarkerFile()
 
-	err := report.GenerateReport(ctx)
+	var err error
+	if ingest {
+		err = report.GenerateReport(ctx)
+	} else {
+		err = report.GenerateReportFromState(ctx)
+	}
+	storage.LogDiskUsage()
 	if err != nil {
-		log.Fatal(custom_error.New("Error generating report", err))
+		if ctx.Err() != nil {
+			progress.Finish(progress.PhaseStopped)
+			return custom_error.New("stopped, run again to resume", ctx.Err())
+		}
+		progress.Finish(progress.PhaseFailed)
+		return custom_error.New("Error generating report", err)
 	}
 
-	if global.UseStorage {
+	if !global.UseStorage {
+		err := storage.ClearSpill()
+		if err != nil {
+			log.Println(custom_error.New("error clearing spilled users", err))
+		}
+	}
+	if global.KeepState || !global.UseStorage {
+		err := storage.RemoveInterruptedMarkerFile()
+		if err != nil {
+			log.Println(custom_error.New("error completing run", err))
+		}
+	} else {
 		err := storage.ClearTempStorage()
 		if err != nil {
 			log.Println(custom_error.New("error clearing tmp storage", err))
 		}
 	}
+	//after the state is cleared, so what the run did can still be seen
+	progress.Finish(progress.PhaseDone)
 
-	if err := ctx.Err(); err != nil {
-		log.Fatal(err)
+	return nil
+}
+
+// validationSkipped names what keeps the report from being compared line by
+// line with a verification file, which only covers a full report in the
+// summary format
+func validationSkipped() string {
+	switch {
+	case global.DeltaReport:
+		return "delta report"
+	case global.ReportPartUsers > 0 || global.ReportPartBytes > 0:
+		return "partitioned report"
+	case global.EventBuckets != "" && !global.ReportEventTotals:
+		return "bucketed events"
+	case global.ReportSegmentsColumn:
+		return "segments column"
+	case global.AsOf != 0:
+		return "as-of report"
+	case global.ReportSeen:
+		return "seen timestamps"
+	case global.EventAggregations != "":
+		return "aggregated events"
+	case global.ReportProjectionPath != "":
+		return "projected report"
+	case global.ReportFormat != "summary":
+		return global.ReportFormat + " format"
 	}
 
-	err = validate(global.ReportFilePath, verifyFile)
+	return ""
+}
+
+// validateReport checks the report against verifyFile, when there is one.  A
+// report that can't be compared line by line is still checked to count as
+// many users as verifyFile
+func validateReport(verifyFile string) error {
+	if verifyFile == "" {
+		log.Println("SUCCESS")
+		return nil
+	}
+	if reason := validationSkipped(); reason != "" {
+		log.Printf("report not compared line by line with %s, which only covers a full summary report: %s",
+			verifyFile, reason)
+		//an as-of report leaves out the users only seen later
+		if global.AsOf != 0 {
+			log.Println("SUCCESS (validation skipped for " + reason + ")")
+			return nil
+		}
+
+		err := validateUserCount(global.StatsJsonFilePath, verifyFile)
+		if err != nil {
+			return custom_error.New("Error validating report", err)
+		}
+		log.Println("SUCCESS (user count validated, lines not compared for " + reason + ")")
+		return nil
+	}
+
+	err := validate(global.ReportFilePath, verifyFile)
+	if errors.Is(err, errMismatch) {
+		log.Printf("for every difference run: %s diff %s %s", os.Args[0], global.ReportFilePath, verifyFile)
+	}
 	if err != nil {
-		log.Fatal(custom_error.New("Error validating report", err))
+		return custom_error.New("Error validating report", err)
 	}
 
 	log.Println("SUCCESS")
+	return nil
+}
+
+// validateUserCount checks the users counted in the stats of the report
+// against the lines of the verification file, one per user
+func validateUserCount(statsFile, verifyFile string) error {
+	byteArray, err := os.ReadFile(statsFile)
+	if err != nil {
+		return err
+	}
+	stats := struct {
+		Users int64 `json:"users"`
+	}{}
+	err = json.Unmarshal(byteArray, &stats)
+	if err != nil {
+		return fmt.Errorf("invalid stats %s: %w", statsFile, err)
+	}
+
+	f, err := os.Open(verifyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var users int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			users++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if stats.Users != users {
+		return fmt.Errorf("%w: report has %d users, want %d", errMismatch, stats.Users, users)
+	}
+
+	return nil
+}
+
+// unix seconds, as record timestamps are, or RFC3339
+func parseAsOf(value string) (int64, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+		return seconds, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("expected unix seconds or an RFC3339 timestamp, found %q", value)
+	}
 
-	os.Exit(0)
+	return t.Unix(), nil
 }
 
 // Quick validation of expected and received input.
@@ -94,16 +540,16 @@ func validate(have, want string) error {
 	s2 := bufio.NewScanner(f2)
 	for s1.Scan() {
 		if !s2.Scan() {
-			return fmt.Errorf("want: insufficient data")
+			return fmt.Errorf("%w: want: insufficient data", errMismatch)
 		}
 		t1 := s1.Text()
 		t2 := s2.Text()
-		if t1 != t2 {
-			return fmt.Errorf("have/want: difference\n%s\n%s", t1, t2)
+		if t1 != t2 && !sameSummaryLine(t1, t2) {
+			return fmt.Errorf("%w: have/want: difference\n%s\n%s", errMismatch, t1, t2)
 		}
 	}
 	if s2.Scan() {
-		return fmt.Errorf("have: insufficient data")
+		return fmt.Errorf("%w: have: insufficient data", errMismatch)
 	}
 	if err := s1.Err(); err != nil {
 		return err
@@ -113,3 +559,18 @@ func validate(have, want string) error {
 	}
 	return nil
 }
+
+// lines differing only in how they are escaped hold the same data
+func sameSummaryLine(have, want string) bool {
+	l1, err := report.ParseSummaryLine(have)
+	if err != nil {
+		return false
+	}
+
+	l2, err := report.ParseSummaryLine(want)
+	if err != nil {
+		return false
+	}
+
+	return l1.Equal(l2)
+}
@@ -11,6 +11,18 @@ type User struct {
 	ID         int
 	Attributes map[string]*Attribute
 	Events     map[string]*Event
+
+	// report generations in which the user first appeared and last changed,
+	// 0 when not tracked
+	CreatedGeneration  int `json:",omitempty"`
+	ModifiedGeneration int `json:",omitempty"`
+	// report generation in which the first seen, last seen or set_at
+	// timestamps of the user last moved, deltas count it with -seen
+	SeenGeneration int `json:",omitempty"`
+
+	// timestamps of the earliest and latest records of the user, 0 when not tracked
+	FirstSeen int64 `json:",omitempty"`
+	LastSeen  int64 `json:",omitempty"`
 }
 
 type UserHistory struct {
@@ -18,9 +30,20 @@ type UserHistory struct {
 	Attributes  map[string]*Attribute
 	Event       *Event
 	HistoryType HistoryType
+	Timestamp   int64
+	// data fields of an event record
+	EventData map[string]string
 }
 
 type Attribute struct {
+	// when the value was set
+	Timestamp int64
+	Value     string
+	// values by time, oldest first, when attribute history is kept
+	History []AttributeValue `json:",omitempty"`
+}
+
+type AttributeValue struct {
 	Timestamp int64
 	Value     string
 }
@@ -29,4 +52,21 @@ type Event struct {
 	NumOccurrances int
 	Ids            map[string]struct{}
 	Name           string
+
+	// occurrences by time bucket label, when events are bucketed
+	Buckets map[string]int `json:",omitempty"`
+	// numeric data fields aggregated over the occurrences, by field name
+	Aggregates map[string]*Aggregate `json:",omitempty"`
+	// timestamps of the earliest and latest occurrences, 0 when not tracked
+	FirstSeen int64 `json:",omitempty"`
+	LastSeen  int64 `json:",omitempty"`
+}
+
+// Aggregate accumulates one numeric data field of an event, occurrences
+// without a numeric value aren't counted
+type Aggregate struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
 }
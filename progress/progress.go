@@ -0,0 +1,245 @@
+package progress
+
+import (
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/storage"
+	"log"
+	"os"
+	"time"
+)
+
+// phases of a run, as written to the progress file
+const (
+	PhaseIngest  = "ingest"
+	PhaseReport  = "report"
+	PhaseDone    = "done"
+	PhaseStopped = "stopped"
+	PhaseFailed  = "failed"
+)
+
+// tracker follows the run every global.ProgressInterval, logging a line and
+// rewriting the progress file in the state directory
+type tracker struct {
+	progress storage.Progress
+
+	phaseStarted time.Time
+	lastSaved    time.Time
+	// counters of the ingest, nil until its first record.  A resumed run
+	// skips the records read before it, which would inflate its rate, so
+	// rates start from where this run's ingest did
+	counters     *storage.IngestCounters
+	startBytes   int64
+	startRecords int64
+	// users a resumed report had already written, left out of its rate
+	startUsers int64
+}
+
+var current *tracker
+
+func enabled() bool {
+	return global.ProgressInterval > 0
+}
+
+func start() *tracker {
+	if current == nil {
+		current = &tracker{
+			progress: storage.Progress{Pid: os.Getpid(), StartedAt: time.Now().Unix(), EtaSeconds: -1},
+		}
+	}
+
+	return current
+}
+
+// StartIngest begins the ingest of inputFile
+func StartIngest(inputFile string) {
+	if !enabled() {
+		return
+	}
+
+	t := start()
+	t.progress.Phase = PhaseIngest
+	t.progress.InputFile = inputFile
+	if info, err := os.Stat(inputFile); err == nil {
+		t.progress.InputBytes = info.Size()
+	}
+	t.phaseStarted = time.Now()
+	t.lastSaved = t.phaseStarted
+	t.save()
+}
+
+// Ingested follows the ingest to a record read up to position, counted in
+// counters
+func Ingested(position int64, counters *storage.IngestCounters) {
+	if current == nil || current.progress.Phase != PhaseIngest {
+		return
+	}
+
+	t := current
+	if t.counters == nil {
+		t.startBytes = position
+		t.startRecords = counters.Records - 1
+		t.phaseStarted = time.Now()
+	}
+	t.counters = counters
+	t.progress.BytesRead = position
+
+	t.tick()
+}
+
+// StateUsers starts the count of users from those already in state, so an
+// ingest into storage, resumed or not, counts every user the state will hold
+func StateUsers(users int) {
+	if current != nil {
+		current.progress.Users = int64(users)
+	}
+}
+
+// NewUser counts a user new to the ingest
+func NewUser() {
+	if current != nil {
+		current.progress.Users++
+	}
+}
+
+// StartReport begins writing the report of users
+func StartReport(users int) {
+	if !enabled() {
+		return
+	}
+
+	t := start()
+	t.progress.Phase = PhaseReport
+	t.progress.ReportUsers = int64(users)
+	t.progress.ReportUsersWritten = 0
+	t.startUsers = 0
+	t.phaseStarted = time.Now()
+	t.lastSaved = t.phaseStarted
+	t.save()
+}
+
+// Reported counts a user done with by the report, alreadyWritten when a
+// resumed report had written it before
+func Reported(alreadyWritten bool) {
+	if current == nil || current.progress.Phase != PhaseReport {
+		return
+	}
+
+	t := current
+	t.progress.ReportUsersWritten++
+	if alreadyWritten {
+		//skipping is no measure of the rate, it starts after the last one
+		t.startUsers = t.progress.ReportUsersWritten
+		t.phaseStarted = time.Now()
+		return
+	}
+	t.tick()
+}
+
+// Finish records how the run ended, phase is PhaseDone, PhaseStopped or
+// PhaseFailed
+func Finish(phase string) {
+	if current == nil {
+		return
+	}
+
+	current.copyCounters()
+	current.progress.Phase = phase
+	current.progress.EtaSeconds = 0
+	if phase != PhaseDone {
+		current.progress.EtaSeconds = -1
+	}
+	current.saveFile()
+	current = nil
+}
+
+func (t *tracker) tick() {
+	if time.Since(t.lastSaved) < global.ProgressInterval {
+		return
+	}
+
+	t.save()
+}
+
+// save logs the progress and writes it to the progress file
+func (t *tracker) save() {
+	now := time.Now()
+	t.lastSaved = now
+	elapsed := now.Sub(t.phaseStarted).Seconds()
+
+	p := &t.progress
+	p.EtaSeconds = -1
+	switch p.Phase {
+	case PhaseIngest:
+		t.copyCounters()
+		if elapsed > 0 && t.counters != nil {
+			p.RecordsPerSecond = float64(p.Records-t.startRecords) / elapsed
+			bytesPerSecond := float64(p.BytesRead-t.startBytes) / elapsed
+			if bytesPerSecond > 0 {
+				p.EtaSeconds = int64(float64(p.InputBytes-p.BytesRead) / bytesPerSecond)
+			}
+		}
+	case PhaseReport:
+		if elapsed > 0 {
+			p.UsersPerSecond = float64(p.ReportUsersWritten-t.startUsers) / elapsed
+			if p.UsersPerSecond > 0 {
+				p.EtaSeconds = int64(float64(p.ReportUsers-p.ReportUsersWritten) / p.UsersPerSecond)
+			}
+		}
+	}
+	log.Println("progress: " + Line(p))
+
+	t.saveFile()
+}
+
+func (t *tracker) copyCounters() {
+	if t.counters != nil {
+		t.progress.Records = t.counters.Records
+		t.progress.Rejected = t.counters.Rejected
+		t.progress.Duplicates = t.counters.Duplicates
+	}
+}
+
+func (t *tracker) saveFile() {
+	t.progress.UpdatedAt = time.Now().Unix()
+	err := storage.SaveProgress(&t.progress)
+	if err != nil {
+		//progress is only informative, the run carries on without it
+		log.Println(custom_error.New("error saving progress", err))
+	}
+}
+
+// Line describes the progress of a run in a line
+func Line(p *storage.Progress) string {
+	switch p.Phase {
+	case PhaseIngest:
+		return fmt.Sprintf("ingest %s, %s of %s, %d records at %.0f/s, %d users, %d duplicates, %d rejected, eta %s",
+			percent(p.BytesRead, p.InputBytes), storage.FormatBytes(p.BytesRead), storage.FormatBytes(p.InputBytes),
+			p.Records, p.RecordsPerSecond, p.Users, p.Duplicates, p.Rejected, eta(p.EtaSeconds))
+	case PhaseReport:
+		return fmt.Sprintf("report %s, %d of %d users at %.0f/s, eta %s",
+			percent(p.ReportUsersWritten, p.ReportUsers), p.ReportUsersWritten, p.ReportUsers,
+			p.UsersPerSecond, eta(p.EtaSeconds))
+	}
+
+	return fmt.Sprintf("%s, %s of %s read, %d records, %d users, %d of %d users reported",
+		p.Phase, storage.FormatBytes(p.BytesRead), storage.FormatBytes(p.InputBytes),
+		p.Records, p.Users, p.ReportUsersWritten, p.ReportUsers)
+}
+
+func percent(done, total int64) string {
+	if total <= 0 {
+		return "?%"
+	}
+
+	return fmt.Sprintf("%.1f%%", float64(done)*100/float64(total))
+}
+
+func eta(seconds int64) string {
+	if seconds < 0 {
+		return "unknown"
+	}
+
+	return (time.Duration(seconds) * time.Second).String()
+}
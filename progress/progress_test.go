@@ -0,0 +1,60 @@
+package progress
+
+import (
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/storage"
+	"math"
+	"testing"
+	"time"
+)
+
+// useTracker follows a run into a fresh state directory, only saving when
+// asked to, for the length of the test
+func useTracker(t *testing.T) {
+	t.Helper()
+
+	previousDirectory, previousInterval := storage.StateDirectory(), global.ProgressInterval
+	storage.SetStateDirectory(t.TempDir())
+	global.ProgressInterval = time.Hour
+	t.Cleanup(func() {
+		storage.SetStateDirectory(previousDirectory)
+		global.ProgressInterval = previousInterval
+		current = nil
+	})
+}
+
+func TestResumedReportRate(t *testing.T) {
+	useTracker(t)
+
+	StartReport(4)
+	Reported(true)
+	Reported(true)
+	Reported(false)
+
+	//one user written by this run in a second
+	current.phaseStarted = time.Now().Add(-time.Second)
+	current.save()
+
+	p := current.progress
+	if p.ReportUsersWritten != 3 {
+		t.Errorf("ReportUsersWritten = %d, want 3", p.ReportUsersWritten)
+	}
+	if math.Abs(p.UsersPerSecond-1) > 0.1 {
+		t.Errorf("UsersPerSecond = %.2f, want 1 leaving out the users already written", p.UsersPerSecond)
+	}
+	if p.EtaSeconds != 1 && p.EtaSeconds != 0 {
+		t.Errorf("EtaSeconds = %d, want about 1", p.EtaSeconds)
+	}
+}
+
+func TestIngestUsersFromState(t *testing.T) {
+	useTracker(t)
+
+	StartIngest("missing.jsonl")
+	StateUsers(3)
+	NewUser()
+
+	if got := current.progress.Users; got != 4 {
+		t.Errorf("Users = %d, want 4 counting those already in state", got)
+	}
+}
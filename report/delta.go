@@ -0,0 +1,201 @@
+package report
+
+import (
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/progress"
+	"github.com/customerio/homework/storage"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const addedChange = "added"
+const changedChange = "changed"
+
+// deltas are written next to the full report, data/output.txt generation 3
+// is data/output.delta.3.txt
+func deltaReportPath(reportPath string, generation int) string {
+	ext := filepath.Ext(reportPath)
+	return strings.TrimSuffix(reportPath, ext) + ".delta." + strconv.Itoa(generation) + ext
+}
+
+func deltaManifestPath(reportPath string, generation int) string {
+	ext := filepath.Ext(reportPath)
+	return strings.TrimSuffix(reportPath, ext) + ".delta." + strconv.Itoa(generation) + ".manifest.json"
+}
+
+// checkDeltaReport fails before anything is ingested when there is nothing to
+// compare against
+func checkDeltaReport(generations *storage.Generations) error {
+	if !global.UseStorage || !global.KeepState {
+		return errors.New("delta reports need state kept on disk between runs")
+	}
+	if generations.BaseGeneration == 0 {
+		return errors.New("no full report to base a delta on, run a full report first")
+	}
+
+	return nil
+}
+
+// writeDeltaReport writes only the users changed since the last report, each
+// line prefixed with whether the user was added or changed, followed by a
+// manifest linking the delta to its base full report
+func writeDeltaReport(
+	pass *reportPass,
+	generations *storage.Generations,
+	sortedUserIds []int,
+	userHistories map[int]*models.User) error {
+
+	generation := generations.NextGeneration()
+	path := deltaReportPath(global.ReportFilePath, generation)
+
+	writer, err := storage.OpenReportWriter(path, global.UseStorage)
+	if err != nil {
+		return custom_error.New("error opening delta report", err).Log()
+	}
+
+	if header := pass.formatter.Header(); header != "" && !writer.Resumed() {
+		err = writer.WriteHeader(withChange(pass.formatter, header, "change") + "\n")
+		if err != nil {
+			_ = writer.Close()
+			return custom_error.New("error writing delta report header", err).Log()
+		}
+	}
+
+	manifest := &storage.DeltaManifest{
+		Generation:         generation,
+		PreviousGeneration: generations.LastGeneration,
+		BaseGeneration:     generations.BaseGeneration,
+		BaseReport:         generations.BaseReport,
+		DeltaReport:        path,
+		Format:             global.ReportFormat,
+	}
+
+	printErr := printDeltaForEachUser(
+		pass, writer, generations.LastGeneration, manifest, sortedUserIds, userHistories)
+	if printErr != nil && !errors.Is(printErr, storage.ErrCorruptState) {
+		err = writer.Close()
+		if err != nil {
+			log.Println(custom_error.New("error closing delta report", err))
+		}
+		return custom_error.New("error printing delta report", printErr).Log()
+	}
+
+	err = writer.Commit()
+	if err != nil {
+		return custom_error.New("error completing delta report", err).Log()
+	}
+
+	err = pass.save()
+	if err != nil {
+		return custom_error.New("error saving dataset statistics and segments", err).Log()
+	}
+
+	manifest.CreatedAt = time.Now().UTC()
+	err = storage.SaveDeltaManifest(deltaManifestPath(global.ReportFilePath, generation), manifest)
+	if err != nil {
+		return custom_error.New("error saving delta manifest", err).Log()
+	}
+
+	_, err = storage.CompleteDeltaReport()
+	if err != nil {
+		return custom_error.New("error recording delta report generation", err).Log()
+	}
+
+	log.Printf("delta report %s: %d added, %d changed, %d unchanged omitted\n",
+		path, manifest.Added, manifest.Changed, manifest.UnchangedOmitted)
+
+	if printErr != nil {
+		return custom_error.New("error printing delta report", printErr).Log()
+	}
+
+	return nil
+}
+
+func printDeltaForEachUser(
+	pass *reportPass,
+	writer *storage.ReportWriter,
+	lastGeneration int,
+	manifest *storage.DeltaManifest,
+	sortedUserIds []int,
+	userHistories map[int]*models.User) error {
+
+	restoreLastProcessedUserId, resumed := writer.LastUserId()
+	corruptUsers := 0
+
+	for _, userId := range sortedUserIds {
+		alreadyWritten := resumed && restoreLastProcessedUserId >= userId
+		progress.Reported(alreadyWritten)
+
+		//users already written on a resumed run are still loaded so the
+		//manifest, statistics and segments count every user
+		user, err := loadUser(userId, userHistories)
+		if errors.Is(err, storage.ErrFutureStateVersion) {
+			return custom_error.New(fmt.Sprintf("refusing to report userId: %d", userId), err)
+		} else if err != nil {
+			log.Println(
+				custom_error.New(
+					fmt.Sprintf("error loading state userId: %d", userId), err))
+			corruptUsers++
+			continue
+		}
+		segmentNames := pass.observe(user)
+
+		//users from state that didn't track generations are always included
+		modifiedGeneration := user.ModifiedGeneration
+		if global.ReportSeen && user.SeenGeneration > modifiedGeneration {
+			modifiedGeneration = user.SeenGeneration
+		}
+		if modifiedGeneration != 0 && modifiedGeneration <= lastGeneration {
+			manifest.UnchangedOmitted++
+			continue
+		}
+
+		change := changedChange
+		if user.CreatedGeneration > lastGeneration {
+			change = addedChange
+			manifest.Added++
+		} else {
+			manifest.Changed++
+		}
+
+		if alreadyWritten {
+			continue
+		}
+
+		line, err := pass.formatter.Format(pass.entry(user, segmentNames))
+		if err != nil {
+			return custom_error.New(
+				fmt.Sprintf("error formatting user for delta report.  UserId: %d", userId), err).Log()
+		}
+
+		err = writer.WriteUser(userId, withChange(pass.formatter, line, change)+"\n")
+		if err != nil {
+			return custom_error.New(
+				fmt.Sprintf("error writing user to delta report.  UserId: %d", userId), err).Log()
+		}
+	}
+
+	if corruptUsers > 0 {
+		msg := fmt.Sprintf("%d users missing from delta report due to unreadable state, run fsck to repair", corruptUsers)
+		return custom_error.New(msg, storage.ErrCorruptState)
+	}
+
+	return nil
+}
+
+// the change leads each line, as a first key of ndjson objects or else as a
+// first column
+func withChange(formatter Formatter, line string, change string) string {
+	if _, ok := formatter.(*ndjsonFormatter); ok {
+		return `{"change":"` + change + `",` + line[1:]
+	}
+
+	return change + "," + line
+}
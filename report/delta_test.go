@@ -0,0 +1,173 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useReportRun runs the test in a fresh temporary directory, so the report
+// and the other files under data/ are its own, and keeps the state of runs
+// there between runs
+func useReportRun(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the state directory is created by main before a run
+	err = os.MkdirAll(filepath.Join(dir, "state"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir("data", os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := struct {
+		input, format                string
+		useStorage, keepState, delta bool
+		stateDirectory               string
+	}{
+		global.InputFilePath, global.ReportFormat,
+		global.UseStorage, global.KeepState, global.DeltaReport,
+		storage.StateDirectory(),
+	}
+
+	global.InputFilePath = filepath.Join(dir, "input.data")
+	global.ReportFormat = "summary"
+	global.UseStorage, global.KeepState, global.DeltaReport = true, true, false
+	storage.SetStateDirectory(filepath.Join(dir, "state"))
+
+	t.Cleanup(func() {
+		global.InputFilePath, global.ReportFormat = previous.input, previous.format
+		global.UseStorage, global.KeepState, global.DeltaReport = previous.useStorage, previous.keepState, previous.delta
+		storage.SetStateDirectory(previous.stateDirectory)
+		_ = os.Chdir(workingDirectory)
+	})
+
+	return dir
+}
+
+// runReport ingests records, one json object per line, into the kept state
+// and writes the report
+func runReport(t *testing.T, delta bool, records ...string) {
+	t.Helper()
+
+	err := os.WriteFile(global.InputFilePath, []byte(strings.Join(records, "\n")+"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global.DeltaReport = delta
+	err = GenerateReport(context.Background())
+	if err != nil {
+		t.Fatalf("GenerateReport: %v", err)
+	}
+}
+
+func readReport(t *testing.T, path string) string {
+	t.Helper()
+
+	byteArray, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(byteArray)
+}
+
+func TestDeltaReportMembership(t *testing.T) {
+	useReportRun(t)
+
+	runReport(t, false,
+		`{"id": "a1", "type": "attributes", "user_id": "1", "data": {"email": "one@b.com"}, "timestamp": 10}`,
+		`{"id": "e1", "type": "event", "name": "login", "user_id": "1", "data": {}, "timestamp": 11}`,
+		`{"id": "a2", "type": "attributes", "user_id": "2", "data": {"email": "two@b.com"}, "timestamp": 12}`,
+		`{"id": "a4", "type": "attributes", "user_id": "4", "data": {"email": "four@b.com"}, "timestamp": 13}`,
+	)
+
+	runReport(t, true,
+		//a duplicate event and an attribute set again to its value leave user 1 unchanged
+		`{"id": "e1", "type": "event", "name": "login", "user_id": "1", "data": {}, "timestamp": 11}`,
+		`{"id": "a5", "type": "attributes", "user_id": "1", "data": {"email": "one@b.com"}, "timestamp": 20}`,
+		`{"id": "e2", "type": "event", "name": "login", "user_id": "2", "data": {}, "timestamp": 21}`,
+		`{"id": "a3", "type": "attributes", "user_id": "3", "data": {"email": "three@b.com"}, "timestamp": 22}`,
+		`{"id": "a6", "type": "attributes", "user_id": "4", "data": {"email": "new@b.com"}, "timestamp": 23}`,
+	)
+
+	got := readReport(t, deltaReportPath(global.ReportFilePath, 2))
+	want := "changed,2,email=two@b.com,login=1\n" +
+		"added,3,email=three@b.com\n" +
+		"changed,4,email=new@b.com\n"
+	if got != want {
+		t.Errorf("delta report = %q, want %q", got, want)
+	}
+
+	manifest := storage.DeltaManifest{}
+	err := json.Unmarshal([]byte(readReport(t, deltaManifestPath(global.ReportFilePath, 2))), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Added != 1 || manifest.Changed != 2 || manifest.UnchangedOmitted != 1 ||
+		manifest.BaseGeneration != 1 || manifest.BaseReport != global.ReportFilePath {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	//nothing changed since the last delta
+	runReport(t, true,
+		`{"id": "e2", "type": "event", "name": "login", "user_id": "2", "data": {}, "timestamp": 21}`)
+	if got := readReport(t, deltaReportPath(global.ReportFilePath, 3)); got != "" {
+		t.Errorf("delta of unchanged users = %q, want none", got)
+	}
+}
+
+func TestDeltaReportNeedsBase(t *testing.T) {
+	useReportRun(t)
+
+	global.DeltaReport = true
+	if err := GenerateReport(context.Background()); err == nil {
+		t.Errorf("delta report without a full report to base it on succeeded")
+	}
+}
+
+func TestDeltaReportSeen(t *testing.T) {
+	useReportRun(t)
+	previous := global.ReportSeen
+	t.Cleanup(func() { global.ReportSeen = previous })
+
+	runReport(t, false,
+		`{"id": "a1", "type": "attributes", "user_id": "1", "data": {"email": "one@b.com"}, "timestamp": 10}`,
+		`{"id": "a2", "type": "attributes", "user_id": "2", "data": {"email": "two@b.com"}, "timestamp": 12}`,
+	)
+
+	//setting an attribute again to its value only moves when it was set and
+	//when the user was last seen
+	global.ReportSeen = true
+	runReport(t, true,
+		`{"id": "a3", "type": "attributes", "user_id": "1", "data": {"email": "one@b.com"}, "timestamp": 20}`)
+	got := readReport(t, deltaReportPath(global.ReportFilePath, 2))
+	want := "changed,1,email=one@b.com,email.set_at=20,first_seen=10,last_seen=20\n"
+	if got != want {
+		t.Errorf("delta report with -seen = %q, want %q", got, want)
+	}
+
+	global.ReportSeen = false
+	runReport(t, true,
+		`{"id": "a4", "type": "attributes", "user_id": "2", "data": {"email": "two@b.com"}, "timestamp": 30}`)
+	if got := readReport(t, deltaReportPath(global.ReportFilePath, 3)); got != "" {
+		t.Errorf("delta report without -seen = %q, want none", got)
+	}
+}
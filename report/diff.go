@@ -0,0 +1,368 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ReportDiff compares two summary reports as data: users are matched by id
+// and their fields by name, so neither line order within a user nor escaping
+// counts as a difference.  Counts cover every user, the user lists stop at
+// the limit given to DiffSummaryReports
+type ReportDiff struct {
+	Have string `json:"have"`
+	Want string `json:"want"`
+
+	UsersCompared   int64 `json:"users_compared"`
+	UsersMatching   int64 `json:"users_matching"`
+	UsersMismatched int64 `json:"users_mismatched"`
+	UsersMissing    int64 `json:"users_missing"`
+	UsersExtra      int64 `json:"users_extra"`
+
+	// mismatched users per attribute or event name, keyed attribute:name or event:name, or
+	// field:name when the lines don't show which
+	FieldMismatches map[string]int64 `json:"field_mismatches"`
+
+	// only in want
+	MissingUserIds []int `json:"missing_user_ids"`
+	// only in have
+	ExtraUserIds []int       `json:"extra_user_ids"`
+	Mismatched   []*UserDiff `json:"mismatched"`
+	Truncated    bool        `json:"truncated"`
+}
+
+// UserDiff lists the fields of one user that differ, a missing side is nil
+type UserDiff struct {
+	UserID int          `json:"user_id"`
+	Fields []*FieldDiff `json:"fields"`
+}
+
+type FieldDiff struct {
+	Kind string  `json:"kind"`
+	Name string  `json:"name"`
+	Have *string `json:"have"`
+	Want *string `json:"want"`
+}
+
+// Equal reports whether the reports hold the same users with the same data
+func (d *ReportDiff) Equal() bool {
+	return d.UsersMismatched == 0 && d.UsersMissing == 0 && d.UsersExtra == 0
+}
+
+// DiffSummaryReports compares the summary report have against want.  Both
+// are read once, side by side, so they must be sorted by user_id as reports
+// are.  At most limit users are listed per kind of difference
+func DiffSummaryReports(have, want string, limit int) (*ReportDiff, error) {
+	haveReader, err := openSummaryReader(have)
+	if err != nil {
+		return nil, err
+	}
+	defer haveReader.close()
+
+	wantReader, err := openSummaryReader(want)
+	if err != nil {
+		return nil, err
+	}
+	defer wantReader.close()
+
+	diff := &ReportDiff{
+		Have:            have,
+		Want:            want,
+		FieldMismatches: map[string]int64{},
+		MissingUserIds:  []int{},
+		ExtraUserIds:    []int{},
+		Mismatched:      []*UserDiff{},
+	}
+
+	haveLine, err := haveReader.next()
+	if err != nil {
+		return nil, err
+	}
+	wantLine, err := wantReader.next()
+	if err != nil {
+		return nil, err
+	}
+
+	for haveLine != nil || wantLine != nil {
+		switch {
+		case wantLine == nil || (haveLine != nil && haveLine.UserID < wantLine.UserID):
+			diff.UsersExtra++
+			if len(diff.ExtraUserIds) < limit {
+				diff.ExtraUserIds = append(diff.ExtraUserIds, haveLine.UserID)
+			} else {
+				diff.Truncated = true
+			}
+			haveLine, err = haveReader.next()
+
+		case haveLine == nil || wantLine.UserID < haveLine.UserID:
+			diff.UsersMissing++
+			if len(diff.MissingUserIds) < limit {
+				diff.MissingUserIds = append(diff.MissingUserIds, wantLine.UserID)
+			} else {
+				diff.Truncated = true
+			}
+			wantLine, err = wantReader.next()
+
+		default:
+			diff.UsersCompared++
+			diff.addUser(haveLine, wantLine, limit)
+			haveLine, err = haveReader.next()
+			if err == nil {
+				wantLine, err = wantReader.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return diff, nil
+}
+
+func (d *ReportDiff) addUser(have, want *SummaryLine, limit int) {
+	haveFields := have.fieldsByName()
+	wantFields := want.fieldsByName()
+	resolveKinds(haveFields, wantFields)
+	resolveKinds(wantFields, haveFields)
+
+	keys := make([]string, 0, len(wantFields))
+	for key := range wantFields {
+		keys = append(keys, key)
+	}
+	for key := range haveFields {
+		if _, ok := wantFields[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	user := &UserDiff{UserID: want.UserID}
+	for _, key := range keys {
+		haveField, inHave := haveFields[key]
+		wantField, inWant := wantFields[key]
+		if inHave && inWant && haveField.value == wantField.value {
+			continue
+		}
+
+		fieldDiff := &FieldDiff{}
+		if inHave {
+			value := haveField.value
+			fieldDiff.Have = &value
+			fieldDiff.Name = haveField.name
+			fieldDiff.Kind = haveField.kind
+		}
+		if inWant {
+			value := wantField.value
+			fieldDiff.Want = &value
+			fieldDiff.Name = wantField.name
+			fieldDiff.Kind = wantField.kind
+		}
+		user.Fields = append(user.Fields, fieldDiff)
+		d.FieldMismatches[fieldDiff.Kind+":"+fieldDiff.Name]++
+	}
+
+	if len(user.Fields) == 0 {
+		d.UsersMatching++
+		return
+	}
+
+	d.UsersMismatched++
+	if len(d.Mismatched) < limit {
+		d.Mismatched = append(d.Mismatched, user)
+	} else {
+		d.Truncated = true
+	}
+}
+
+type summaryField struct {
+	name  string
+	kind  string
+	value string
+}
+
+// fieldsByName keys the fields of a line by kind and name, so an attribute
+// and an event of the same name never stand in for each other.  Their kind
+// is only known from where the line has them: both are written sorted by
+// name, attributes first, so the events start where the names stop
+// increasing.  The fields of a line whose names never do are of kind
+// "field", see resolveKinds
+func (s *SummaryLine) fieldsByName() map[string]summaryField {
+	eventsStart := -1
+	for i := 1; i < len(s.Fields); i++ {
+		if s.Fields[i].Name <= s.Fields[i-1].Name {
+			eventsStart = i
+			break
+		}
+	}
+
+	fields := make(map[string]summaryField, len(s.Fields))
+	for i, field := range s.Fields {
+		kind := "field"
+		if eventsStart >= 0 && i < eventsStart {
+			kind = "attribute"
+		} else if eventsStart >= 0 {
+			kind = "event"
+		}
+		fields[kind+":"+field.Name] = summaryField{name: field.Name, kind: kind, value: formatValue(field.Value)}
+	}
+
+	return fields
+}
+
+// resolveKinds gives the fields of unknown kind the kind the other line has
+// a field of the same name as, when it has only the one
+func resolveKinds(fields, other map[string]summaryField) {
+	for key, field := range fields {
+		if field.kind != "field" {
+			continue
+		}
+
+		_, isAttribute := other["attribute:"+field.name]
+		_, isEvent := other["event:"+field.name]
+		if isAttribute == isEvent {
+			continue
+		}
+
+		field.kind = "attribute"
+		if isEvent {
+			field.kind = "event"
+		}
+		delete(fields, key)
+		fields[field.kind+":"+field.name] = field
+	}
+}
+
+// Text renders the diff for people
+func (d *ReportDiff) Text() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "have: %s\nwant: %s\n", d.Have, d.Want)
+	fmt.Fprintf(&buf, "users compared:   %d\n", d.UsersCompared)
+	fmt.Fprintf(&buf, "users matching:   %d\n", d.UsersMatching)
+	fmt.Fprintf(&buf, "users mismatched: %d\n", d.UsersMismatched)
+	fmt.Fprintf(&buf, "users missing:    %d\n", d.UsersMissing)
+	fmt.Fprintf(&buf, "users extra:      %d\n", d.UsersExtra)
+
+	if len(d.FieldMismatches) > 0 {
+		keys := make([]string, 0, len(d.FieldMismatches))
+		for key := range d.FieldMismatches {
+			keys = append(keys, key)
+		}
+		//most often mismatched first
+		sort.Slice(keys, func(i, j int) bool {
+			if d.FieldMismatches[keys[i]] != d.FieldMismatches[keys[j]] {
+				return d.FieldMismatches[keys[i]] > d.FieldMismatches[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+
+		w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "\nfield\tusers mismatched")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%d\n", key, d.FieldMismatches[key])
+		}
+		_ = w.Flush()
+	}
+
+	if len(d.MissingUserIds) > 0 {
+		fmt.Fprintf(&buf, "\nmissing users: %s\n", joinUserIds(d.MissingUserIds))
+	}
+	if len(d.ExtraUserIds) > 0 {
+		fmt.Fprintf(&buf, "\nextra users: %s\n", joinUserIds(d.ExtraUserIds))
+	}
+
+	for _, user := range d.Mismatched {
+		fmt.Fprintf(&buf, "\nuser %d\n", user.UserID)
+		w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+		for _, field := range user.Fields {
+			fmt.Fprintf(w, "  %s %s\thave: %s\twant: %s\n",
+				field.Kind, field.Name, diffValue(field.Have), diffValue(field.Want))
+		}
+		_ = w.Flush()
+	}
+
+	if d.Truncated {
+		fmt.Fprintln(&buf, "\n(lists truncated, counts cover every user)")
+	}
+
+	return buf.Bytes()
+}
+
+func diffValue(value *string) string {
+	if value == nil {
+		return "(none)"
+	}
+
+	return strconv.Quote(*value)
+}
+
+func joinUserIds(userIds []int) string {
+	ids := make([]string, len(userIds))
+	for i, userId := range userIds {
+		ids[i] = strconv.Itoa(userId)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+// summaryReader reads a summary report a line at a time, checking it is in
+// user_id order.  Lines of wide users are longer than a bufio.Scanner allows
+type summaryReader struct {
+	path       string
+	file       *os.File
+	reader     *bufio.Reader
+	lineNumber int
+	lastUserId int
+	started    bool
+}
+
+func openSummaryReader(path string) (*summaryReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &summaryReader{path: path, file: f, reader: bufio.NewReader(f)}, nil
+}
+
+// next returns the next user's line, nil at the end of the report
+func (r *summaryReader) next() (*SummaryLine, error) {
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" && err == io.EOF {
+			return nil, nil
+		}
+		r.lineNumber++
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+
+		summary, err := ParseSummaryLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", r.path, r.lineNumber, err)
+		}
+		if r.started && summary.UserID <= r.lastUserId {
+			return nil, fmt.Errorf("%s:%d: user_id %d is out of order, reports must be sorted by user_id",
+				r.path, r.lineNumber, summary.UserID)
+		}
+		r.lastUserId = summary.UserID
+		r.started = true
+
+		return summary, nil
+	}
+}
+
+func (r *summaryReader) close() {
+	_ = r.file.Close()
+}
@@ -0,0 +1,117 @@
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestReport(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestDiffSummaryReports(t *testing.T) {
+	dir := t.TempDir()
+	want := writeTestReport(t, dir, "want.txt",
+		"1,email=a@b.com,purchase=2\n"+
+			"2,city=Paris,email=b@b.com,click=1\n"+
+			"3,email=c@b.com\n"+
+			"5,note=x\\,y\n")
+	have := writeTestReport(t, dir, "have.txt",
+		"1,email=a@b.com,purchase=2\n"+
+			"2,city=Lyon,email=b@b.com,click=1,purchase=1\n"+
+			"4,email=d@b.com\n"+
+			"5,note=x\\,y\n")
+
+	diff, err := DiffSummaryReports(have, want, 10)
+	if err != nil {
+		t.Fatalf("DiffSummaryReports: %v", err)
+	}
+
+	if diff.Equal() {
+		t.Errorf("different reports are equal")
+	}
+	counts := []int64{diff.UsersCompared, diff.UsersMatching, diff.UsersMismatched, diff.UsersMissing, diff.UsersExtra}
+	if !reflect.DeepEqual(counts, []int64{3, 2, 1, 1, 1}) {
+		t.Errorf("compared, matching, mismatched, missing, extra = %v, want [3 2 1 1 1]", counts)
+	}
+	if !reflect.DeepEqual(diff.MissingUserIds, []int{3}) || !reflect.DeepEqual(diff.ExtraUserIds, []int{4}) {
+		t.Errorf("missing %v, extra %v, want [3] and [4]", diff.MissingUserIds, diff.ExtraUserIds)
+	}
+	wantMismatches := map[string]int64{"attribute:city": 1, "event:purchase": 1}
+	if !reflect.DeepEqual(diff.FieldMismatches, wantMismatches) {
+		t.Errorf("field mismatches = %v, want %v", diff.FieldMismatches, wantMismatches)
+	}
+
+	if len(diff.Mismatched) != 1 || diff.Mismatched[0].UserID != 2 || len(diff.Mismatched[0].Fields) != 2 {
+		t.Fatalf("mismatched = %+v, want user 2 with two fields", diff.Mismatched)
+	}
+	purchase := diff.Mismatched[0].Fields[1]
+	if purchase.Name != "purchase" || purchase.Have == nil || *purchase.Have != "1" || purchase.Want != nil {
+		t.Errorf("purchase diff = %+v, want only in have", purchase)
+	}
+}
+
+func TestDiffSummaryReportsEqual(t *testing.T) {
+	dir := t.TempDir()
+	//escaping and field order don't count
+	want := writeTestReport(t, dir, "want.txt", "1,a=x\\,y,b=1\n2,c=z\n")
+	have := writeTestReport(t, dir, "have.txt", "1,b=1,a=x\\,y\n\n2,c=z\n")
+
+	diff, err := DiffSummaryReports(have, want, 10)
+	if err != nil {
+		t.Fatalf("DiffSummaryReports: %v", err)
+	}
+	if !diff.Equal() || diff.UsersMatching != 2 {
+		t.Errorf("diff of equal reports = %+v", diff)
+	}
+}
+
+func TestDiffSummaryReportsLimit(t *testing.T) {
+	dir := t.TempDir()
+	want := writeTestReport(t, dir, "want.txt", "1,a=1\n2,a=1\n3,a=1\n")
+	have := writeTestReport(t, dir, "have.txt", "")
+
+	diff, err := DiffSummaryReports(have, want, 2)
+	if err != nil {
+		t.Fatalf("DiffSummaryReports: %v", err)
+	}
+	if diff.UsersMissing != 3 || !reflect.DeepEqual(diff.MissingUserIds, []int{1, 2}) || !diff.Truncated {
+		t.Errorf("missing %d %v truncated %t, want 3 [1 2] true", diff.UsersMissing, diff.MissingUserIds, diff.Truncated)
+	}
+}
+
+func TestDiffSummaryReportsErrors(t *testing.T) {
+	dir := t.TempDir()
+	sorted := writeTestReport(t, dir, "sorted.txt", "1,a=1\n2,a=1\n")
+
+	tests := []struct {
+		name   string
+		report string
+	}{
+		{"out of order", "2,a=1\n1,a=1\n"},
+		{"not a summary line", "1,a=1\nuser two\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			have := writeTestReport(t, dir, "have.txt", test.report)
+			if _, err := DiffSummaryReports(have, sorted, 10); err == nil {
+				t.Errorf("diff of %q succeeded, want an error", test.report)
+			}
+		})
+	}
+
+	if _, err := DiffSummaryReports(filepath.Join(dir, "missing.txt"), sorted, 10); err == nil {
+		t.Errorf("diff of a missing report succeeded")
+	}
+}
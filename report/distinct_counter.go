@@ -0,0 +1,64 @@
+package report
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+)
+
+// distinctCounter estimates the number of distinct values with a k minimum
+// values sketch: it keeps the k smallest value hashes, which is exact until
+// more than k distinct values are seen and uses bounded memory after that
+type distinctCounter struct {
+	k      int
+	hashes hashHeap
+	seen   map[uint64]struct{}
+}
+
+func newDistinctCounter(k int) *distinctCounter {
+	return &distinctCounter{k: k, seen: make(map[uint64]struct{})}
+}
+
+func (c *distinctCounter) Add(value string) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+	hash := h.Sum64()
+
+	if _, ok := c.seen[hash]; ok {
+		return
+	}
+	if len(c.hashes) == c.k {
+		if hash >= c.hashes[0] {
+			return
+		}
+		delete(c.seen, heap.Pop(&c.hashes).(uint64))
+	}
+
+	heap.Push(&c.hashes, hash)
+	c.seen[hash] = struct{}{}
+}
+
+// Estimate returns the number of distinct values and whether it is estimated
+func (c *distinctCounter) Estimate() (int64, bool) {
+	if len(c.hashes) < c.k {
+		return int64(len(c.hashes)), false
+	}
+
+	//the kth smallest of n uniform hashes sits near k/n of the hash space
+	kth := float64(c.hashes[0]) / math.MaxUint64
+	return int64(math.Round(float64(c.k-1) / kth)), true
+}
+
+// hashHeap is a max heap, so the largest of the k smallest hashes is on top
+type hashHeap []uint64
+
+func (h hashHeap) Len() int            { return len(h) }
+func (h hashHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *hashHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,384 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/user_history"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Field is a single named value of a report line.  Attribute values are
+// strings, event counts are ints
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// String renders the field as name=value, unescaped
+func (f Field) String() string {
+	return f.Name + "=" + formatValue(f.Value)
+}
+
+// Entry is the format independent content of one user's report line
+type Entry struct {
+	UserID     int
+	Attributes []Field
+	Events     []Field
+	// names of the segments the user belongs to, written as the last column
+	// when global.ReportSegmentsColumn is set
+	Segments []string
+
+	// for formats rendering the user directly
+	user *models.User
+}
+
+// between segment names in a single column, names can't contain it
+const segmentSeparator = ";"
+
+// name of the segments column, reserved in the formats where attributes and
+// events share a namespace with it
+const segmentsColumn = "segments"
+
+// checkSegmentsColumn fails when the segments column is written and an
+// attribute or event would be written under its name too
+func checkSegmentsColumn(entry *Entry) error {
+	if !global.ReportSegmentsColumn {
+		return nil
+	}
+
+	for _, section := range []struct {
+		kind   string
+		fields []Field
+	}{{"attribute", entry.Attributes}, {"event", entry.Events}} {
+		for _, field := range section.fields {
+			if field.Name == segmentsColumn {
+				return fmt.Errorf("%s %q clashes with the segments column, rename or exclude it with -projection",
+					section.kind, field.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Formatter renders report entries in one output format
+type Formatter interface {
+	// Header is written once at the top of the report, "" for none
+	Header() string
+	// Format renders one entry without the trailing newline
+	Format(entry *Entry) (string, error)
+}
+
+// collectingFormatter is implemented by formatters that must see every
+// entry, before the first line is written, to build their header
+type collectingFormatter interface {
+	Formatter
+	Collect(entry *Entry)
+}
+
+var formatters = map[string]func() (Formatter, error){
+	"summary": func() (Formatter, error) { return &summaryFormatter{}, nil },
+	"ndjson":  func() (Formatter, error) { return &ndjsonFormatter{}, nil },
+	"csv": func() (Formatter, error) {
+		return &wideCsvFormatter{attributes: map[string]struct{}{}, events: map[string]struct{}{}}, nil
+	},
+	"template": func() (Formatter, error) { return newTemplateFormatter(global.ReportTemplatePath) },
+}
+
+// NewFormatter returns the formatter registered under name, failing when it
+// can't be configured
+func NewFormatter(name string) (Formatter, error) {
+	newFormatter, ok := formatters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown report format %q, expected one of: %s", name, strings.Join(FormatNames(), ", "))
+	}
+
+	return newFormatter()
+}
+
+func FormatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// attributes and events each sorted by name, events given as their bucketed
+// series when global.EventBuckets is set unless totals are asked for, each
+// followed by its configured aggregations.  With global.ReportSeen attributes
+// are followed by when they were set, and the user and each event by when
+// they were first and last seen
+func newEntry(user *models.User) *Entry {
+	entry := &Entry{UserID: user.ID, user: user}
+
+	for _, attrKey := range user_history.SortAttributes(user.Attributes) {
+		entry.Attributes = append(entry.Attributes, Field{attrKey, user.Attributes[attrKey].Value})
+		if global.ReportSeen {
+			entry.Attributes = append(entry.Attributes, Field{attrKey + ".set_at", user.Attributes[attrKey].Timestamp})
+		}
+	}
+	if global.ReportSeen {
+		entry.Attributes = appendSeen(entry.Attributes, "", user.FirstSeen, user.LastSeen)
+	}
+
+	for _, eventName := range user_history.SortEvents(user.Events) {
+		event := user.Events[eventName]
+		if global.EventBuckets == "" || global.ReportEventTotals || len(event.Buckets) == 0 {
+			entry.Events = append(entry.Events, Field{eventName, event.NumOccurrances})
+		} else {
+			//the series, one field per bucket in time order
+			for _, bucket := range sortedBuckets(event.Buckets) {
+				entry.Events = append(entry.Events, Field{eventName + "@" + bucket, event.Buckets[bucket]})
+			}
+		}
+
+		if global.ReportSeen {
+			entry.Events = appendSeen(entry.Events, eventName+".", event.FirstSeen, event.LastSeen)
+		}
+
+		for _, aggregation := range user_history.EventAggregations() {
+			if aggregation.Event != eventName {
+				continue
+			}
+			if value, ok := aggregation.Value(event); ok {
+				entry.Events = append(entry.Events, Field{aggregation.Name(), value})
+			}
+		}
+	}
+
+	return entry
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// summaryFormatter is the original user_id,attr=value,event=count format,
+// with delimiters in names and values escaped
+type summaryFormatter struct{}
+
+func (f *summaryFormatter) Header() string {
+	return ""
+}
+
+func (f *summaryFormatter) Format(entry *Entry) (string, error) {
+	err := checkSegmentsColumn(entry)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(strconv.Itoa(entry.UserID))
+	for _, fields := range [][]Field{entry.Attributes, entry.Events} {
+		for _, field := range fields {
+			sb.WriteString(",")
+			sb.WriteString(EscapeSummaryValue(field.Name))
+			sb.WriteString("=")
+			sb.WriteString(EscapeSummaryValue(formatValue(field.Value)))
+		}
+	}
+	if global.ReportSegmentsColumn {
+		sb.WriteString("," + segmentsColumn + "=")
+		sb.WriteString(EscapeSummaryValue(strings.Join(entry.Segments, segmentSeparator)))
+	}
+
+	return sb.String(), nil
+}
+
+// ndjsonFormatter writes one {"user_id":..,"attributes":{..},"events":{..}} object per line
+type ndjsonFormatter struct{}
+
+func (f *ndjsonFormatter) Header() string {
+	return ""
+}
+
+func (f *ndjsonFormatter) Format(entry *Entry) (string, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString(`{"user_id":`)
+	buf.WriteString(strconv.Itoa(entry.UserID))
+
+	for _, section := range []struct {
+		name   string
+		fields []Field
+	}{{"attributes", entry.Attributes}, {"events", entry.Events}} {
+		buf.WriteString(`,"` + section.name + `":`)
+		err := writeJsonObject(&buf, section.fields)
+		if err != nil {
+			return "", err
+		}
+	}
+	if global.ReportSegmentsColumn {
+		segments, err := json.Marshal(append([]string{}, entry.Segments...))
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(`,"` + segmentsColumn + `":`)
+		buf.Write(segments)
+	}
+	buf.WriteString("}")
+
+	return buf.String(), nil
+}
+
+// fields are written in order, json.Marshal of a map would sort them
+func writeJsonObject(buf *bytes.Buffer, fields []Field) error {
+	buf.WriteString("{")
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(name)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+
+	return nil
+}
+
+// wideCsvFormatter writes one column per attribute and event name seen across
+// all users, attributes first, each sorted by name.  Missing values are empty
+type wideCsvFormatter struct {
+	attributes map[string]struct{}
+	events     map[string]struct{}
+
+	attributeColumns []string
+	eventColumns     []string
+}
+
+func (f *wideCsvFormatter) Collect(entry *Entry) {
+	for _, field := range entry.Attributes {
+		f.attributes[field.Name] = struct{}{}
+	}
+	for _, field := range entry.Events {
+		f.events[field.Name] = struct{}{}
+	}
+
+	f.attributeColumns = nil
+	f.eventColumns = nil
+}
+
+func (f *wideCsvFormatter) columns() ([]string, []string) {
+	if f.attributeColumns == nil && f.eventColumns == nil {
+		f.attributeColumns = sortedKeys(f.attributes)
+		f.eventColumns = sortedKeys(f.events)
+	}
+
+	return f.attributeColumns, f.eventColumns
+}
+
+func (f *wideCsvFormatter) Header() string {
+	attributeColumns, eventColumns := f.columns()
+
+	record := append([]string{"user_id"}, attributeColumns...)
+	record = append(record, eventColumns...)
+	if global.ReportSegmentsColumn {
+		record = append(record, segmentsColumn)
+	}
+
+	return csvLine(record)
+}
+
+func (f *wideCsvFormatter) Format(entry *Entry) (string, error) {
+	err := checkSegmentsColumn(entry)
+	if err != nil {
+		return "", err
+	}
+
+	attributeColumns, eventColumns := f.columns()
+
+	record := make([]string, 0, 1+len(attributeColumns)+len(eventColumns))
+	record = append(record, strconv.Itoa(entry.UserID))
+	record = appendColumns(record, attributeColumns, entry.Attributes)
+	record = appendColumns(record, eventColumns, entry.Events)
+	if global.ReportSegmentsColumn {
+		record = append(record, strings.Join(entry.Segments, segmentSeparator))
+	}
+
+	return csvLine(record), nil
+}
+
+func appendColumns(record []string, columns []string, fields []Field) []string {
+	values := make(map[string]string, len(fields))
+	for _, field := range fields {
+		values[field.Name] = formatValue(field.Value)
+	}
+
+	for _, column := range columns {
+		record = append(record, values[column])
+	}
+
+	return record
+}
+
+// csv quoting of a single record, without the trailing newline
+func csvLine(record []string) string {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write(record)
+	writer.Flush()
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// first_seen and last_seen, left out when not tracked
+func appendSeen(fields []Field, prefix string, firstSeen, lastSeen int64) []Field {
+	if firstSeen == 0 && lastSeen == 0 {
+		return fields
+	}
+
+	return append(fields, Field{prefix + "first_seen", firstSeen}, Field{prefix + "last_seen", lastSeen})
+}
+
+// bucket labels sort in time order
+func sortedBuckets(buckets map[string]int) []string {
+	labels := make([]string, 0, len(buckets))
+	for label := range buckets {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	return labels
+}
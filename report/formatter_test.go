@@ -0,0 +1,142 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/customerio/homework/global"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testEntries() []*Entry {
+	return []*Entry{
+		{UserID: 1, Attributes: []Field{{"email", "a@b.com"}, {"note", "says \"hi\", twice"}}, Events: []Field{{"purchase", 2}}},
+		{UserID: 2, Attributes: []Field{{"city", "Paris"}}, Events: []Field{{"login", 1}, {"purchase.price.avg", 12.5}}},
+	}
+}
+
+func newTestFormatter(t *testing.T, name string) Formatter {
+	t.Helper()
+
+	formatter, err := NewFormatter(name)
+	if err != nil {
+		t.Fatalf("NewFormatter(%s): %v", name, err)
+	}
+
+	return formatter
+}
+
+func TestNdjsonFormatter(t *testing.T) {
+	formatter := newTestFormatter(t, "ndjson")
+	if header := formatter.Header(); header != "" {
+		t.Errorf("Header = %q, want none", header)
+	}
+
+	want := []string{
+		`{"user_id":1,"attributes":{"email":"a@b.com","note":"says \"hi\", twice"},"events":{"purchase":2}}`,
+		`{"user_id":2,"attributes":{"city":"Paris"},"events":{"login":1,"purchase.price.avg":12.5}}`,
+	}
+	for i, entry := range testEntries() {
+		line, err := formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("Format: %v", err)
+		}
+		if line != want[i] {
+			t.Errorf("Format = %s, want %s", line, want[i])
+		}
+
+		//every line is an object on its own
+		object := map[string]interface{}{}
+		if err = json.Unmarshal([]byte(line), &object); err != nil {
+			t.Errorf("line %s isn't json: %v", line, err)
+		}
+	}
+
+	line, err := formatter.Format(&Entry{UserID: 3})
+	if err != nil || line != `{"user_id":3,"attributes":{},"events":{}}` {
+		t.Errorf("Format of an empty entry = %s, %v", line, err)
+	}
+}
+
+func TestCsvFormatter(t *testing.T) {
+	formatter := newTestFormatter(t, "csv")
+	collector, ok := formatter.(collectingFormatter)
+	if !ok {
+		t.Fatalf("csv formatter doesn't collect its columns")
+	}
+
+	entries := testEntries()
+	for _, entry := range entries {
+		collector.Collect(entry)
+	}
+
+	report := formatter.Header() + "\n"
+	for _, entry := range entries {
+		line, err := formatter.Format(entry)
+		if err != nil {
+			t.Fatalf("Format: %v", err)
+		}
+		report += line + "\n"
+	}
+
+	records, err := csv.NewReader(strings.NewReader(report)).ReadAll()
+	if err != nil {
+		t.Fatalf("report isn't csv: %v\n%s", err, report)
+	}
+	want := [][]string{
+		{"user_id", "city", "email", "note", "login", "purchase", "purchase.price.avg"},
+		{"1", "", "a@b.com", `says "hi", twice`, "", "2", ""},
+		{"2", "Paris", "", "", "1", "", "12.5"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("csv report = %q, want %q", records, want)
+	}
+}
+
+func TestNewFormatterUnknown(t *testing.T) {
+	if _, err := NewFormatter("xml"); err == nil {
+		t.Errorf("NewFormatter(xml) succeeded")
+	}
+}
+
+func TestSegmentsColumnIsReserved(t *testing.T) {
+	previous := global.ReportSegmentsColumn
+	global.ReportSegmentsColumn = true
+	t.Cleanup(func() { global.ReportSegmentsColumn = previous })
+
+	entries := []*Entry{
+		{UserID: 1, Attributes: []Field{{"segments", "vip"}}, Segments: []string{"boston"}},
+		{UserID: 1, Events: []Field{{"segments", 1}}, Segments: []string{"boston"}},
+	}
+
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{"summary", true},
+		{"csv", true},
+		//attributes and events are objects of their own
+		{"ndjson", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			formatter := newTestFormatter(t, test.format)
+			for _, entry := range entries {
+				if collector, ok := formatter.(collectingFormatter); ok {
+					collector.Collect(entry)
+				}
+				_, err := formatter.Format(entry)
+				if (err != nil) != test.wantErr {
+					t.Errorf("Format(%v) err = %v, want error %t", entry, err, test.wantErr)
+				}
+			}
+		})
+	}
+
+	global.ReportSegmentsColumn = false
+	if _, err := newTestFormatter(t, "summary").Format(entries[0]); err != nil {
+		t.Errorf("Format without the segments column: %v", err)
+	}
+}
@@ -2,136 +2,335 @@ package report
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/customerio/homework/custom_error"
 	"github.com/customerio/homework/global"
 	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/progress"
 	"github.com/customerio/homework/storage"
 	"github.com/customerio/homework/stream"
 	"github.com/customerio/homework/user_history"
 	"log"
-	"strconv"
-	"strings"
 )
 
+// GenerateReport ingests global.InputFilePath and writes the report
 func GenerateReport(ctx context.Context) error {
-	if !global.WasInterrupted {
-		err := storage.DeleteReportFile()
+	return generateReport(ctx, true)
+}
+
+// GenerateReportFromState writes the report from the state kept by an earlier
+// run, reading no input
+func GenerateReportFromState(ctx context.Context) error {
+	return generateReport(ctx, false)
+}
+
+func generateReport(ctx context.Context, ingest bool) error {
+	formatter, err := NewFormatter(global.ReportFormat)
+	if err != nil {
+		return custom_error.New("error creating report formatter", err).Log()
+	}
+
+	generations, err := storage.LoadGenerations()
+	if err != nil {
+		return custom_error.New("error loading report generations", err).Log()
+	}
+	if global.DeltaReport {
+		err = checkDeltaReport(generations)
 		if err != nil {
-			return custom_error.New("Error deleting report file", err).Log()
+			return custom_error.New("unable to write delta report", err).Log()
 		}
 	}
 
-	recordStream, err := stream.GetRecords(ctx)
-	if err != nil {
-		return custom_error.New("error getting record stream", err).Log()
+	var ingestCounters *storage.IngestCounters
+	if !ingest {
+		ingestCounters, err = loadStateForReport()
+		if err != nil {
+			return err
+		}
 	}
 
-	//create users with their associated Events and Attributes
-	//global.UseStorage saves user files to disk
-	//non global.UseStorage maintains entire list in memory
-	var userHistories map[int]*models.User
-	if global.UseStorage {
-		_, err = user_history.CreateHistories(recordStream)
-	} else {
-		userHistories, err = user_history.CreateHistories(recordStream)
+	//a delta leaves the full report it is based on in place
+	if !global.WasInterrupted && !global.DeltaReport {
+		err := storage.DeleteReportFile()
+		if err != nil {
+			return custom_error.New("Error deleting report file", err).Log()
+		}
 	}
-	if err != nil {
-		return custom_error.New("error updating histories", err).Log()
+
+	var userHistories map[int]*models.User
+	if ingest {
+		userHistories, ingestCounters, err = createHistories(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
 	var sortedUserIds []int
-	var restoreLastProcessedUserId int
 	//get list of user ids numerically sorted
 	if global.UseStorage {
 		sortedUserIds, err = storage.LoadAllUserIds()
 		if err != nil {
 			return custom_error.New("error getting sorted user ids from storage", err).Log()
 		}
+	} else {
+		//users spilled over the memory budget are read back as they come up
+		spilledUserIds, err := storage.LoadSpilledUserIds()
+		if err != nil {
+			return custom_error.New("error getting sorted spilled user ids", err).Log()
+		}
+		sortedUserIds = user_history.MergeUserIds(user_history.SortUserIds(userHistories), spilledUserIds)
+	}
+
+	sortedUserIds, err = removeForgottenUsers(sortedUserIds)
+	if err != nil {
+		return custom_error.New("error removing forgotten users", err).Log()
+	}
+
+	pass, err := newReportPass(formatter, ingestCounters)
+	if err != nil {
+		return custom_error.New("error configuring report", err).Log()
+	}
+
+	//formats with a header built from every user need a first pass over all of them
+	if collector, ok := formatter.(collectingFormatter); ok {
+		err = collectEntries(collector, pass, sortedUserIds, userHistories)
+		if err != nil {
+			return custom_error.New("error collecting report columns", err).Log()
+		}
+	}
+
+	progress.StartReport(len(sortedUserIds))
+	if global.DeltaReport {
+		return writeDeltaReport(pass, generations, sortedUserIds, userHistories)
+	}
+
+	writer, err := openReportWriter(formatter)
+	if err != nil {
+		return custom_error.New("error opening report", err).Log()
+	}
 
-		if storage.CheckReportFileExist() {
-			restoreLastProcessedUserId = storage.MoveToReportEnd()
+	printErr := printReportForEachUser(pass, writer, sortedUserIds, userHistories)
+	if printErr != nil && !errors.Is(printErr, storage.ErrCorruptState) {
+		//keep the checkpoint so the next run carries on from here
+		err = writer.Close()
+		if err != nil {
+			log.Println(custom_error.New("error closing Report File", err))
 		}
-	} else {
-		sortedUserIds = user_history.SortUserIds(userHistories)
+		return custom_error.New("error printing report", printErr).Log()
 	}
 
-	err = printReportForEachUser(sortedUserIds, userHistories, restoreLastProcessedUserId)
+	err = writer.Commit()
+	if err != nil {
+		return custom_error.New("error completing report", err).Log()
+	}
 
-	err = storage.CloseReportFile()
+	err = pass.save()
 	if err != nil {
-		log.Println(custom_error.New("error closing Report File", err))
+		return custom_error.New("error saving dataset statistics and segments", err).Log()
+	}
+
+	//later deltas are based on this report, a split one is known by its manifest
+	if global.KeepState {
+		basePath := global.ReportFilePath
+		if global.ReportPartUsers > 0 || global.ReportPartBytes > 0 {
+			basePath = storage.ReportManifestPath(global.ReportFilePath)
+		}
+		_, err = storage.CompleteFullReport(basePath)
+		if err != nil {
+			return custom_error.New("error recording report generation", err).Log()
+		}
+	}
+
+	if printErr != nil {
+		return custom_error.New("error printing report", printErr).Log()
 	}
 
 	return nil
 }
 
-func printReportForEachUser(
-	sortedUserIds []int,
-	userHistories map[int]*models.User,
-	restoreLastProcessedUserId int) error {
+// create users with their associated Events and Attributes
+// global.UseStorage saves user files to disk
+// non global.UseStorage maintains entire list in memory
+func createHistories(ctx context.Context) (map[int]*models.User, *storage.IngestCounters, error) {
+	progress.StartIngest(global.InputFilePath)
+	recordStream, err := stream.GetRecords(ctx)
+	if err != nil {
+		return nil, nil, custom_error.New("error getting record stream", err).Log()
+	}
 
-	for _, userId := range sortedUserIds {
-		//on interruption restore, skip along sortedUserIds until we get to
-		//the one next after last written to report
-		if restoreLastProcessedUserId >= userId {
-			continue
-		}
+	userHistories, ingestCounters, err := user_history.CreateHistories(ctx, recordStream)
+	if err != nil {
+		return nil, nil, custom_error.New("error updating histories", err).Log()
+	}
+	if global.UseStorage {
+		return nil, ingestCounters, nil
+	}
 
-		var user *models.User
-		if global.UseStorage {
-			var err error
-			user, err = storage.LoadUserState(userId)
-			if err != nil {
-				log.Println(
-					custom_error.New(
-						fmt.Sprintf("error loading state userId: %d", userId), err))
-				continue
-			}
-		} else {
-			user = userHistories[userId]
-		}
+	return userHistories, ingestCounters, nil
+}
+
+// only a finished ingest kept with -keep-state can be reported again
+func loadStateForReport() (*storage.IngestCounters, error) {
+	if !global.UseStorage {
+		return nil, errors.New("no state to report from, users are only kept in memory")
+	}
+	if storage.CheckRecordOffsetExist() {
+		return nil, errors.New("ingest into the state didn't finish, run it again to complete it")
+	}
+	if !storage.HasIngestCounters() {
+		return nil, errors.New("no finished ingest in " + storage.StateDirectory() + ", run with -keep-state first")
+	}
+
+	//events are reported as the state was built
+	err := user_history.AdoptIngestSettings()
+	if err != nil {
+		return nil, custom_error.New("error loading the settings of the state", err).Log()
+	}
 
-		err := storage.AddLineToReport(printUserEntry(user) + "\n")
+	ingestCounters, err := storage.LoadIngestCounters()
+	if err != nil {
+		return nil, custom_error.New("error loading ingest counters", err).Log()
+	}
+
+	return ingestCounters, nil
+}
+
+// reportWriter is a storage.ReportWriter or, for a report split into parts,
+// a storage.PartitionedReportWriter
+type reportWriter interface {
+	LastUserId() (userId int, ok bool)
+	WriteUser(userId int, line string) error
+	Commit() error
+	Close() error
+}
+
+// only state on disk survives a restart, so only then can the report be resumed
+func openReportWriter(formatter Formatter) (reportWriter, error) {
+	header := formatter.Header()
+	if header != "" {
+		header += "\n"
+	}
+
+	if global.ReportPartUsers > 0 || global.ReportPartBytes > 0 {
+		return storage.OpenPartitionedReportWriter(
+			global.ReportFilePath, header, global.ReportPartUsers, global.ReportPartBytes, global.UseStorage)
+	}
+
+	writer, err := storage.OpenReportWriter(global.ReportFilePath, global.UseStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	if header != "" && !writer.Resumed() {
+		err = writer.WriteHeader(header)
 		if err != nil {
-			return custom_error.New(
-				fmt.Sprintf("error writing user to Report file.  UserId: %d", userId), err).Log()
+			_ = writer.Close()
+			return nil, custom_error.New("error writing report header", err)
 		}
 	}
 
-	return nil
+	return writer, nil
 }
 
-func printUserEntry(user *models.User) string {
-	var sb strings.Builder
+// users forgotten after their state was built are still excluded
+func removeForgottenUsers(sortedUserIds []int) ([]int, error) {
+	tombstones, err := storage.LoadTombstones()
+	if err != nil || len(tombstones) == 0 {
+		return sortedUserIds, err
+	}
 
-	sb.WriteString(strconv.Itoa(user.ID))
-	sb.WriteString(",")
+	remaining := sortedUserIds[:0]
+	for _, userId := range sortedUserIds {
+		if _, ok := tombstones[userId]; !ok {
+			remaining = append(remaining, userId)
+		}
+	}
 
-	printUserAttributesEntry(user, &sb)
-	printUserEventEntry(user, &sb)
+	return remaining, nil
+}
 
-	entry := sb.String()
-	return entry[0 : len(entry)-1]
+func collectEntries(collector collectingFormatter, pass *reportPass, sortedUserIds []int, userHistories map[int]*models.User) error {
+	for _, userId := range sortedUserIds {
+		user, err := loadUser(userId, userHistories)
+		if errors.Is(err, storage.ErrFutureStateVersion) {
+			return custom_error.New(fmt.Sprintf("refusing to report userId: %d", userId), err)
+		} else if err != nil {
+			//reported when printing
+			continue
+		}
+
+		collector.Collect(pass.entry(user, nil))
+	}
+
+	return nil
 }
 
-func printUserAttributesEntry(user *models.User, sb *strings.Builder) {
-	sortedAttributes := user_history.SortAttributes(user.Attributes)
-	for _, attrKey := range sortedAttributes {
-		sb.WriteString(attrKey)
-		sb.WriteString("=")
-		sb.WriteString(user.Attributes[attrKey].Value)
-		sb.WriteString(",")
+func loadUser(userId int, userHistories map[int]*models.User) (*models.User, error) {
+	if global.UseStorage {
+		return storage.LoadUserState(userId)
 	}
+
+	if user, ok := userHistories[userId]; ok {
+		return user, nil
+	}
+
+	return storage.LoadSpilledUser(userId)
 }
 
-func printUserEventEntry(user *models.User, sb *strings.Builder) {
-	sortedEvents := user_history.SortEvents(user.Events)
+func printReportForEachUser(
+	pass *reportPass,
+	writer reportWriter,
+	sortedUserIds []int,
+	userHistories map[int]*models.User) error {
+
+	restoreLastProcessedUserId, resumed := writer.LastUserId()
+
+	//users whose state can't be read are left out of the report, but the
+	//run must not look successful
+	corruptUsers := 0
+
+	for _, userId := range sortedUserIds {
+		alreadyWritten := resumed && restoreLastProcessedUserId >= userId
+		progress.Reported(alreadyWritten)
+
+		//users already written on a resumed run are still loaded so the
+		//statistics and segments cover every user
+		user, err := loadUser(userId, userHistories)
+		if errors.Is(err, storage.ErrFutureStateVersion) {
+			return custom_error.New(fmt.Sprintf("refusing to report userId: %d", userId), err)
+		} else if err != nil {
+			log.Println(
+				custom_error.New(
+					fmt.Sprintf("error loading state userId: %d", userId), err))
+			corruptUsers++
+			continue
+		}
+		segmentNames := pass.observe(user)
+
+		//on interruption restore, skip along sortedUserIds until we get to
+		//the one next after last written to report
+		if alreadyWritten {
+			continue
+		}
+
+		line, err := pass.formatter.Format(pass.entry(user, segmentNames))
+		if err != nil {
+			return custom_error.New(
+				fmt.Sprintf("error formatting user for Report file.  UserId: %d", userId), err).Log()
+		}
 
-	for _, eventName := range sortedEvents {
-		sb.WriteString(eventName)
-		sb.WriteString("=")
-		sb.WriteString(strconv.Itoa(user.Events[eventName].NumOccurrances))
-		sb.WriteString(",")
+		err = writer.WriteUser(userId, line+"\n")
+		if err != nil {
+			return custom_error.New(
+				fmt.Sprintf("error writing user to Report file.  UserId: %d", userId), err).Log()
+		}
 	}
+
+	if corruptUsers > 0 {
+		msg := fmt.Sprintf("%d users missing from report due to unreadable state, run fsck to repair", corruptUsers)
+		return custom_error.New(msg, storage.ErrCorruptState)
+	}
+
+	return nil
 }
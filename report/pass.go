@@ -0,0 +1,97 @@
+package report
+
+import (
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/segments"
+	"github.com/customerio/homework/storage"
+	"path/filepath"
+	"strconv"
+)
+
+// reportPass is what a single pass over every user builds besides the report
+// lines: the statistics and segment membership
+type reportPass struct {
+	formatter  Formatter
+	projection *Projection
+	stats      *Stats
+	segments   *segments.Definitions
+	// member user ids by segment name, ascending
+	members map[string][]int
+}
+
+func newReportPass(formatter Formatter, ingestCounters *storage.IngestCounters) (*reportPass, error) {
+	pass := &reportPass{
+		formatter: formatter,
+		stats:     NewStats(ingestCounters, global.StatsTopUsers),
+		members:   map[string][]int{},
+	}
+
+	var err error
+	if global.ReportProjectionPath != "" {
+		pass.projection, err = LoadProjection(global.ReportProjectionPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if global.SegmentsFilePath != "" {
+		pass.segments, err = segments.Load(global.SegmentsFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pass, nil
+}
+
+// observe accounts for a user, every user must be observed once even when
+// its line was written by an earlier, interrupted run.  Returns the user's segments
+func (p *reportPass) observe(user *models.User) []string {
+	p.stats.AddUser(user)
+
+	if p.segments == nil {
+		return nil
+	}
+
+	names := p.segments.Evaluate(user)
+	for _, name := range names {
+		p.members[name] = append(p.members[name], user.ID)
+	}
+
+	return names
+}
+
+// entry is the user's report line content, projected and with its segments
+func (p *reportPass) entry(user *models.User, segmentNames []string) *Entry {
+	entry := p.projection.Apply(newEntry(user))
+	entry.Segments = segmentNames
+
+	return entry
+}
+
+// save writes the statistics and a membership file per segment
+func (p *reportPass) save() error {
+	err := saveStats(p.stats)
+	if err != nil {
+		return err
+	}
+
+	if p.segments == nil {
+		return nil
+	}
+
+	for _, name := range p.segments.Names() {
+		var byteArray []byte
+		for _, userId := range p.members[name] {
+			byteArray = append(strconv.AppendInt(byteArray, int64(userId), 10), '\n')
+		}
+
+		err = storage.SaveReportFile(filepath.Join(global.SegmentsDirectory, name+".txt"), byteArray)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+// Projection selects, orders and renames the fields of every report entry.
+// It is read from a JSON file such as:
+//
+//	{
+//	  "attributes": {"include": ["email", "first_*"], "rename": {"first_name": "name"}},
+//	  "events": {"include": ["purchase"], "defaults": {"purchase": 0}}
+//	}
+//
+// Templates are executed with the whole user and aren't projected
+type Projection struct {
+	Attributes FieldProjection `json:"attributes"`
+	Events     FieldProjection `json:"events"`
+}
+
+// FieldProjection is applied to the attributes or events of an entry in the
+// order of its fields.  Patterns are path.Match globs on the original names
+type FieldProjection struct {
+	// keep only names matching one of these, all when empty
+	Include []string `json:"include"`
+	// then drop names matching one of these
+	Exclude []string `json:"exclude"`
+	// values for names missing from a user, added even when not included
+	Defaults map[string]interface{} `json:"defaults"`
+	// names written first, in this order, the rest follow sorted by name
+	Order []string `json:"order"`
+	// output names by original name, none of them a name that is kept
+	Rename map[string]string `json:"rename"`
+}
+
+func LoadProjection(filePath string) (*Projection, error) {
+	byteArray, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	projection := &Projection{}
+	err = json.Unmarshal(byteArray, projection)
+	if err != nil {
+		return nil, fmt.Errorf("invalid projection %s: %w", filePath, err)
+	}
+
+	for section, fields := range map[string]*FieldProjection{"attributes": &projection.Attributes, "events": &projection.Events} {
+		err = fields.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid projection %s, %s: %w", filePath, section, err)
+		}
+	}
+
+	return projection, nil
+}
+
+func (p *FieldProjection) validate() error {
+	for _, patterns := range [][]string{p.Include, p.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	//two fields renamed to the same name would be indistinguishable
+	renamedFrom := map[string]string{}
+	for name, rename := range p.Rename {
+		if other, ok := renamedFrom[rename]; ok {
+			return fmt.Errorf("both %q and %q are renamed to %q", name, other, rename)
+		}
+		renamedFrom[rename] = name
+
+		//a field still written under the name would be indistinguishable too
+		_, renamedAway := p.Rename[rename]
+		_, hasDefault := p.Defaults[rename]
+		if !renamedAway && (hasDefault || p.selects(rename)) {
+			return fmt.Errorf("%q is renamed to %q, a name that is kept", name, rename)
+		}
+	}
+
+	return nil
+}
+
+// Apply returns the projected entry, a nil projection leaves it as is
+func (p *Projection) Apply(entry *Entry) *Entry {
+	if p == nil {
+		return entry
+	}
+
+	return &Entry{
+		UserID:     entry.UserID,
+		Attributes: p.Attributes.apply(entry.Attributes),
+		Events:     p.Events.apply(entry.Events),
+		user:       entry.user,
+	}
+}
+
+func (p *FieldProjection) apply(fields []Field) []Field {
+	projected := make([]Field, 0, len(fields)+len(p.Defaults))
+	present := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		present[field.Name] = struct{}{}
+		if p.selects(field.Name) {
+			projected = append(projected, field)
+		}
+	}
+
+	for name, value := range p.Defaults {
+		if _, ok := present[name]; !ok {
+			projected = append(projected, Field{name, value})
+		}
+	}
+
+	rank := make(map[string]int, len(p.Order))
+	for i, name := range p.Order {
+		rank[name] = i
+	}
+	sort.SliceStable(projected, func(i, j int) bool {
+		ri, iOrdered := rank[projected[i].Name]
+		rj, jOrdered := rank[projected[j].Name]
+		if iOrdered || jOrdered {
+			return iOrdered && (!jOrdered || ri < rj)
+		}
+		return projected[i].Name < projected[j].Name
+	})
+
+	for i := range projected {
+		if rename, ok := p.Rename[projected[i].Name]; ok {
+			projected[i].Name = rename
+		}
+	}
+
+	return projected
+}
+
+func (p *FieldProjection) selects(name string) bool {
+	if len(p.Include) > 0 && !matchesAny(p.Include, name) {
+		return false
+	}
+
+	return !matchesAny(p.Exclude, name)
+}
+
+// patterns were checked when loading, so Match can't fail
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
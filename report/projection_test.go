@@ -0,0 +1,100 @@
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFieldProjectionApply(t *testing.T) {
+	fields := []Field{{"city", "Paris"}, {"email", "a@b.com"}, {"first_name", "Ann"}, {"last_name", "Lee"}}
+
+	tests := []struct {
+		name       string
+		projection FieldProjection
+		want       []Field
+	}{
+		{
+			name: "empty keeps every field",
+			want: fields,
+		},
+		{
+			name:       "include globs",
+			projection: FieldProjection{Include: []string{"email", "*_name"}},
+			want:       []Field{{"email", "a@b.com"}, {"first_name", "Ann"}, {"last_name", "Lee"}},
+		},
+		{
+			name:       "exclude after include",
+			projection: FieldProjection{Include: []string{"*_name"}, Exclude: []string{"last_*"}},
+			want:       []Field{{"first_name", "Ann"}},
+		},
+		{
+			name:       "defaults only for missing names",
+			projection: FieldProjection{Include: []string{"email"}, Defaults: map[string]interface{}{"email": "none", "phone": ""}},
+			want:       []Field{{"email", "a@b.com"}, {"phone", ""}},
+		},
+		{
+			name:       "order first then sorted",
+			projection: FieldProjection{Order: []string{"last_name", "email"}},
+			want:       []Field{{"last_name", "Lee"}, {"email", "a@b.com"}, {"city", "Paris"}, {"first_name", "Ann"}},
+		},
+		{
+			name:       "rename after ordering by original name",
+			projection: FieldProjection{Include: []string{"city", "first_name"}, Rename: map[string]string{"first_name": "a_name"}},
+			want:       []Field{{"city", "Paris"}, {"a_name", "Ann"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.projection.apply(fields)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("apply = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProjectionApplyNil(t *testing.T) {
+	entry := &Entry{UserID: 1, Attributes: []Field{{"email", "a@b.com"}}}
+
+	var projection *Projection
+	if got := projection.Apply(entry); got != entry {
+		t.Errorf("nil projection changed the entry to %v", got)
+	}
+}
+
+func TestLoadProjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"valid", `{"attributes": {"include": ["email", "first_*"]}, "events": {"defaults": {"purchase": 0}}}`, false},
+		{"invalid json", `{"attributes": `, true},
+		{"bad pattern", `{"events": {"exclude": ["[a-"]}}`, true},
+		{"clashing renames", `{"attributes": {"rename": {"a": "x", "b": "x"}}}`, true},
+		{"rename to a kept name", `{"attributes": {"rename": {"first_name": "email"}}}`, true},
+		{"rename to an included name", `{"events": {"include": ["a", "b"], "rename": {"a": "b"}}}`, true},
+		{"rename to a default", `{"events": {"include": ["a"], "defaults": {"b": 0}, "rename": {"a": "b"}}}`, true},
+		{"rename to an excluded name", `{"attributes": {"exclude": ["email"], "rename": {"first_name": "email"}}}`, false},
+		{"swapped names", `{"attributes": {"rename": {"a": "b", "b": "a"}}}`, false},
+	}
+
+	dir := t.TempDir()
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filePath := filepath.Join(dir, string(rune('a'+i))+".json")
+			err := os.WriteFile(filePath, []byte(test.json), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = LoadProjection(filePath)
+			if (err != nil) != test.wantErr {
+				t.Errorf("LoadProjection(%s) error = %v, want error %t", test.json, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package report
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/storage"
+	"sort"
+	"text/tabwriter"
+)
+
+// values kept per attribute to estimate its cardinality, exact below this
+const distinctSketchSize = 4096
+
+// Stats summarises the whole dataset, built from the same pass over the users
+// that writes the report
+type Stats struct {
+	ingest     storage.IngestCounters
+	users      int64
+	events     map[string]*eventStats
+	attributes map[string]*attributeStats
+	topUsers   activityHeap
+	topN       int
+}
+
+type eventStats struct {
+	total int64
+	users int64
+}
+
+type attributeStats struct {
+	users    int64
+	distinct *distinctCounter
+}
+
+type userActivity struct {
+	UserID int   `json:"user_id"`
+	Events int64 `json:"events"`
+}
+
+func NewStats(ingest *storage.IngestCounters, topN int) *Stats {
+	return &Stats{
+		ingest:     *ingest,
+		events:     map[string]*eventStats{},
+		attributes: map[string]*attributeStats{},
+		topN:       topN,
+	}
+}
+
+func (s *Stats) AddUser(user *models.User) {
+	s.users++
+
+	var activity int64
+	for name, event := range user.Events {
+		stats, ok := s.events[name]
+		if !ok {
+			stats = &eventStats{}
+			s.events[name] = stats
+		}
+		stats.total += int64(event.NumOccurrances)
+		stats.users++
+		activity += int64(event.NumOccurrances)
+	}
+
+	for name, attribute := range user.Attributes {
+		stats, ok := s.attributes[name]
+		if !ok {
+			stats = &attributeStats{distinct: newDistinctCounter(distinctSketchSize)}
+			s.attributes[name] = stats
+		}
+		stats.users++
+		stats.distinct.Add(attribute.Value)
+	}
+
+	s.addActivity(userActivity{UserID: user.ID, Events: activity})
+}
+
+// keeps the topN most active users, the lowest id first among equals
+func (s *Stats) addActivity(activity userActivity) {
+	if s.topN <= 0 {
+		return
+	}
+	if len(s.topUsers) < s.topN {
+		heap.Push(&s.topUsers, activity)
+		return
+	}
+	if s.topUsers.less(s.topUsers[0], activity) {
+		s.topUsers[0] = activity
+		heap.Fix(&s.topUsers, 0)
+	}
+}
+
+// activityHeap is a min heap, the least active of the top users is on top
+type activityHeap []userActivity
+
+// less orders by activity, a higher id counting as less active
+func (h activityHeap) less(a, b userActivity) bool {
+	if a.Events != b.Events {
+		return a.Events < b.Events
+	}
+	return a.UserID > b.UserID
+}
+
+func (h activityHeap) Len() int            { return len(h) }
+func (h activityHeap) Less(i, j int) bool  { return h.less(h[i], h[j]) }
+func (h activityHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *activityHeap) Push(x interface{}) { *h = append(*h, x.(userActivity)) }
+func (h *activityHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// statsReport is the JSON form of Stats, names sorted
+type statsReport struct {
+	Users           int64                  `json:"users"`
+	RecordsRead     int64                  `json:"records_read"`
+	RecordsRejected int64                  `json:"records_rejected"`
+	DuplicateEvents int64                  `json:"duplicate_events_removed"`
+	Events          []eventStatsReport     `json:"events"`
+	Attributes      []attributeStatsReport `json:"attributes"`
+	TopUsers        []userActivity         `json:"top_users"`
+}
+
+type eventStatsReport struct {
+	Name  string `json:"name"`
+	Total int64  `json:"total"`
+	Users int64  `json:"users"`
+}
+
+type attributeStatsReport struct {
+	Name     string  `json:"name"`
+	Users    int64   `json:"users"`
+	FillRate float64 `json:"fill_rate"`
+	Distinct int64   `json:"distinct_values"`
+	// distinct values are estimated once there are too many to count exactly
+	Estimated bool `json:"distinct_estimated"`
+}
+
+func (s *Stats) report() *statsReport {
+	r := &statsReport{
+		Users:           s.users,
+		RecordsRead:     s.ingest.Records,
+		RecordsRejected: s.ingest.Rejected,
+		DuplicateEvents: s.ingest.Duplicates,
+		Events:          make([]eventStatsReport, 0, len(s.events)),
+		Attributes:      make([]attributeStatsReport, 0, len(s.attributes)),
+	}
+
+	eventNames := make([]string, 0, len(s.events))
+	for name := range s.events {
+		eventNames = append(eventNames, name)
+	}
+	sort.Strings(eventNames)
+	for _, name := range eventNames {
+		stats := s.events[name]
+		r.Events = append(r.Events, eventStatsReport{Name: name, Total: stats.total, Users: stats.users})
+	}
+
+	attributeNames := make([]string, 0, len(s.attributes))
+	for name := range s.attributes {
+		attributeNames = append(attributeNames, name)
+	}
+	sort.Strings(attributeNames)
+	for _, name := range attributeNames {
+		stats := s.attributes[name]
+		distinct, estimated := stats.distinct.Estimate()
+		//every attribute seen belongs to at least one user, s.users isn't 0
+		r.Attributes = append(r.Attributes, attributeStatsReport{
+			Name:      name,
+			Users:     stats.users,
+			FillRate:  float64(stats.users) / float64(s.users),
+			Distinct:  distinct,
+			Estimated: estimated,
+		})
+	}
+
+	r.TopUsers = append([]userActivity{}, s.topUsers...)
+	sort.Slice(r.TopUsers, func(i, j int) bool { return s.topUsers.less(r.TopUsers[j], r.TopUsers[i]) })
+
+	return r
+}
+
+func (s *Stats) Json() ([]byte, error) {
+	byteArray, err := json.MarshalIndent(s.report(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(byteArray, '\n'), nil
+}
+
+// Text renders the stats as aligned tables for people
+func (s *Stats) Text() []byte {
+	r := s.report()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "users:                    %d\n", r.Users)
+	fmt.Fprintf(&buf, "records read:             %d\n", r.RecordsRead)
+	fmt.Fprintf(&buf, "records rejected:         %d\n", r.RecordsRejected)
+	fmt.Fprintf(&buf, "duplicate events removed: %d\n", r.DuplicateEvents)
+
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "\nevent\ttotal\tusers")
+	for _, event := range r.Events {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", event.Name, event.Total, event.Users)
+	}
+
+	fmt.Fprintln(w, "\nattribute\tfill rate\tdistinct values")
+	for _, attribute := range r.Attributes {
+		approximately := ""
+		if attribute.Estimated {
+			approximately = "~"
+		}
+		fmt.Fprintf(w, "%s\t%.1f%%\t%s%d\n",
+			attribute.Name, attribute.FillRate*100, approximately, attribute.Distinct)
+	}
+
+	fmt.Fprintf(w, "\ntop %d users\tevents\n", len(r.TopUsers))
+	for _, user := range r.TopUsers {
+		fmt.Fprintf(w, "%d\t%d\n", user.UserID, user.Events)
+	}
+	_ = w.Flush()
+
+	return buf.Bytes()
+}
+
+// saveStats writes both forms of the stats next to the report
+func saveStats(stats *Stats) error {
+	byteArray, err := stats.Json()
+	if err != nil {
+		return err
+	}
+
+	err = storage.SaveReportFile(global.StatsJsonFilePath, byteArray)
+	if err != nil {
+		return err
+	}
+
+	return storage.SaveReportFile(global.StatsFilePath, stats.Text())
+}
@@ -0,0 +1,124 @@
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Summary lines escape the delimiters with a backslash so any name or value
+// round-trips: "\," "\=" "\\" and the control characters "\n" "\r"
+var summaryEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`,`, `\,`,
+	`=`, `\=`,
+	"\n", `\n`,
+	"\r", `\r`,
+)
+
+// EscapeSummaryValue escapes a name or value for the summary format
+func EscapeSummaryValue(value string) string {
+	return summaryEscaper.Replace(value)
+}
+
+// SummaryLine is a parsed user_id,name=value,... line
+type SummaryLine struct {
+	UserID int
+	// unescaped, in line order: attributes then events
+	Fields []Field
+}
+
+// ParseSummaryLine parses a line written by the summary format, undoing its escaping
+func ParseSummaryLine(line string) (*SummaryLine, error) {
+	parts, err := splitEscaped(line, ',')
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid user_id %q", parts[0])
+	}
+
+	summary := &SummaryLine{UserID: userId, Fields: make([]Field, 0, len(parts)-1)}
+	for _, part := range parts[1:] {
+		pair, err := splitEscaped(part, '=')
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("expected name=value, found %q", part)
+		}
+
+		name, _ := unescapeSummaryValue(pair[0])
+		value, _ := unescapeSummaryValue(pair[1])
+		summary.Fields = append(summary.Fields, Field{Name: name, Value: value})
+	}
+
+	return summary, nil
+}
+
+// Equal compares the user and every field, in order
+func (s *SummaryLine) Equal(other *SummaryLine) bool {
+	if s.UserID != other.UserID || len(s.Fields) != len(other.Fields) {
+		return false
+	}
+
+	for i := range s.Fields {
+		if s.Fields[i] != other.Fields[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitEscaped splits on sep where it isn't escaped, leaving escapes in place
+func splitEscaped(s string, sep byte) ([]string, error) {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("dangling escape at end of %q", s)
+			}
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:]), nil
+}
+
+func unescapeSummaryValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("dangling escape at end of %q", s)
+		}
+
+		switch s[i] {
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,115 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEscapeSummaryValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"plain", "plain"},
+		{"a,b", `a\,b`},
+		{"a=b", `a\=b`},
+		{`a\b`, `a\\b`},
+		{"a\nb\rc", `a\nb\rc`},
+		{`\,=`, `\\\,\=`},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := EscapeSummaryValue(test.value); got != test.want {
+			t.Errorf("EscapeSummaryValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseSummaryLineRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []Field
+	}{
+		{"no fields", nil},
+		{"plain", []Field{{"email", "a@b.com"}, {"purchase", "3"}}},
+		{"delimiters", []Field{{"na,me", "va=lue"}, {"x=y", "1,2"}}},
+		{"backslashes", []Field{{`a\`, `\b\`}, {`\n`, `\\`}}},
+		{"control characters", []Field{{"note", "line\none\rtwo"}}},
+		{"empty value", []Field{{"city", ""}}},
+	}
+
+	formatter := &summaryFormatter{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, err := formatter.Format(&Entry{UserID: 42, Attributes: test.fields})
+			if err != nil {
+				t.Fatalf("Format: %v", err)
+			}
+
+			parsed, err := ParseSummaryLine(line)
+			if err != nil {
+				t.Fatalf("ParseSummaryLine(%q): %v", line, err)
+			}
+			if parsed.UserID != 42 {
+				t.Errorf("UserID = %d, want 42", parsed.UserID)
+			}
+
+			want := test.fields
+			if want == nil {
+				want = []Field{}
+			}
+			if !reflect.DeepEqual(parsed.Fields, want) {
+				t.Errorf("ParseSummaryLine(%q).Fields = %v, want %v", line, parsed.Fields, want)
+			}
+		})
+	}
+}
+
+func TestParseSummaryLineErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"bad user_id", "x,a=b"},
+		{"empty line", ""},
+		{"missing value", "1,a"},
+		{"too many values", "1,a=b=c"},
+		{"dangling escape", `1,a=b\`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseSummaryLine(test.line); err == nil {
+				t.Errorf("ParseSummaryLine(%q) succeeded, want an error", test.line)
+			}
+		})
+	}
+}
+
+func TestSummaryLineEqual(t *testing.T) {
+	escaped, err := ParseSummaryLine(`1,a=x\,y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`1,a=x\,y`, true},
+		{`1,a=x\,z`, false},
+		{`2,a=x\,y`, false},
+		{`1,a=x\,y,b=1`, false},
+	}
+
+	for _, test := range tests {
+		other, err := ParseSummaryLine(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := escaped.Equal(other); got != test.want {
+			t.Errorf("Equal(%q) = %t, want %t", test.line, got, test.want)
+		}
+	}
+}
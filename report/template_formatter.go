@@ -0,0 +1,140 @@
+package report
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/user_history"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// name of the optional template written once at the top of the report
+const headerTemplateName = "header"
+
+// templateFuncs are available to report templates:
+//
+//	{{sortedAttributes .}}      attributes sorted by name, as Fields
+//	{{sortedEvents .}}          events sorted by name, as Fields with their count
+//	{{attribute . "email"}}     an attribute's value, "" when missing
+//	{{eventCount . "purchase"}} an event's count, 0 when missing
+//	{{join "," list}}           strings or Fields, Fields joined as name=value
+//	{{escape value}}            value escaped as in the summary format
+var templateFuncs = template.FuncMap{
+	"sortedAttributes": sortedAttributes,
+	"sortedEvents":     sortedEvents,
+	"attribute": func(user *models.User, name string) string {
+		if attribute, ok := user.Attributes[name]; ok {
+			return attribute.Value
+		}
+		return ""
+	},
+	"eventCount": func(user *models.User, name string) int {
+		if event, ok := user.Events[name]; ok {
+			return event.NumOccurrances
+		}
+		return 0
+	},
+	"join":   joinTemplateValues,
+	"escape": func(value interface{}) string { return EscapeSummaryValue(formatValue(value)) },
+}
+
+// sortedAttributes are only the user's attributes, whatever else the report
+// is configured to add to its entries
+func sortedAttributes(user *models.User) []Field {
+	fields := make([]Field, 0, len(user.Attributes))
+	for _, name := range user_history.SortAttributes(user.Attributes) {
+		fields = append(fields, Field{name, user.Attributes[name].Value})
+	}
+
+	return fields
+}
+
+// sortedEvents are only the user's event counts, whatever else the report is
+// configured to add to its entries
+func sortedEvents(user *models.User) []Field {
+	fields := make([]Field, 0, len(user.Events))
+	for _, name := range user_history.SortEvents(user.Events) {
+		fields = append(fields, Field{name, user.Events[name].NumOccurrances})
+	}
+
+	return fields
+}
+
+func joinTemplateValues(sep string, values interface{}) (string, error) {
+	switch v := values.(type) {
+	case []string:
+		return strings.Join(v, sep), nil
+	case []Field:
+		parts := make([]string, len(v))
+		for i, field := range v {
+			parts[i] = field.String()
+		}
+		return strings.Join(parts, sep), nil
+	default:
+		return "", fmt.Errorf("join expects strings or fields, found %T", values)
+	}
+}
+
+// templateFormatter executes a user supplied text/template with each
+// *models.User.  A template named "header", if defined, is executed once
+// with no data for the first line of the report
+type templateFormatter struct {
+	template *template.Template
+	header   string
+}
+
+// newTemplateFormatter parses the template at path and executes it against an
+// empty user, so mistakes surface before the run rather than at the first user
+func newTemplateFormatter(path string) (Formatter, error) {
+	if path == "" {
+		return nil, errors.New("the template report format needs a template file")
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).
+		Option("missingkey=error").
+		Funcs(templateFuncs).
+		ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid report template: %w", err)
+	}
+
+	f := &templateFormatter{template: tmpl}
+
+	if header := tmpl.Lookup(headerTemplateName); header != nil {
+		var buf bytes.Buffer
+		err = header.Execute(&buf, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid report template header: %w", err)
+		}
+		f.header = strings.TrimSuffix(buf.String(), "\n")
+	}
+
+	_, err = f.execute(&models.User{Attributes: map[string]*models.Attribute{}, Events: map[string]*models.Event{}})
+	if err != nil {
+		return nil, fmt.Errorf("invalid report template: %w", err)
+	}
+
+	return f, nil
+}
+
+func (f *templateFormatter) Header() string {
+	return f.header
+}
+
+func (f *templateFormatter) Format(entry *Entry) (string, error) {
+	return f.execute(entry.user)
+}
+
+// the writer ends every line, a trailing newline in the template file isn't doubled
+func (f *templateFormatter) execute(user *models.User) (string, error) {
+	var buf bytes.Buffer
+	err := f.template.Execute(&buf, user)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
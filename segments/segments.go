@@ -0,0 +1,274 @@
+package segments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/models"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Definitions are the segments of a config file such as:
+//
+//	{"segments": [{
+//	  "name": "boston_buyers",
+//	  "condition": {"and": [
+//	    {"event": "purchase", "op": ">=", "value": 3},
+//	    {"attribute": "city", "op": "=", "value": "Boston"},
+//	    {"not": {"seen": "last_seen", "op": "<", "value": "2019-01-01T00:00:00Z"}}
+//	  ]}
+//	}]}
+type Definitions struct {
+	Segments []*Segment `json:"segments"`
+}
+
+type Segment struct {
+	Name      string     `json:"name"`
+	Condition *Condition `json:"condition"`
+}
+
+// Condition is either a combination of other conditions, with and, or or
+// not, or a comparison of one of:
+//
+//	attribute  the attribute's value, = != contains exists and numeric < <= > >=
+//	event      the event's count, or with seen its first_seen or last_seen time
+//	seen       the user's first_seen or last_seen time
+//
+// Times are compared as unix seconds and may be given as RFC3339
+type Condition struct {
+	And []*Condition `json:"and,omitempty"`
+	Or  []*Condition `json:"or,omitempty"`
+	Not *Condition   `json:"not,omitempty"`
+
+	Attribute string      `json:"attribute,omitempty"`
+	Event     string      `json:"event,omitempty"`
+	Seen      string      `json:"seen,omitempty"`
+	Op        string      `json:"op,omitempty"`
+	Value     interface{} `json:"value,omitempty"`
+
+	// Value as a number, for numeric comparisons
+	number float64
+}
+
+// segment names become membership file names
+var segmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var numericOps = map[string]func(a, b float64) bool{
+	"=":  func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+func Load(path string) (*Definitions, error) {
+	byteArray, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := &Definitions{}
+	err = json.Unmarshal(byteArray, definitions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segments %s: %w", path, err)
+	}
+
+	names := map[string]struct{}{}
+	for i, segment := range definitions.Segments {
+		if !segmentNamePattern.MatchString(segment.Name) {
+			return nil, fmt.Errorf(
+				"invalid segments %s: segment %d: name %q must be letters, digits, _ . or -", path, i, segment.Name)
+		}
+		if _, ok := names[segment.Name]; ok {
+			return nil, fmt.Errorf("invalid segments %s: segment %q defined twice", path, segment.Name)
+		}
+		names[segment.Name] = struct{}{}
+
+		if segment.Condition == nil {
+			return nil, fmt.Errorf("invalid segments %s: segment %q has no condition", path, segment.Name)
+		}
+		err = segment.Condition.prepare()
+		if err != nil {
+			return nil, fmt.Errorf("invalid segments %s: segment %q: %w", path, segment.Name, err)
+		}
+	}
+
+	return definitions, nil
+}
+
+// Names lists the segments in the order defined
+func (d *Definitions) Names() []string {
+	names := make([]string, len(d.Segments))
+	for i, segment := range d.Segments {
+		names[i] = segment.Name
+	}
+
+	return names
+}
+
+// Evaluate returns the names of the segments the user belongs to, in the order defined
+func (d *Definitions) Evaluate(user *models.User) []string {
+	var names []string
+	for _, segment := range d.Segments {
+		if segment.Condition.Matches(user) {
+			names = append(names, segment.Name)
+		}
+	}
+
+	return names
+}
+
+// prepare checks the condition is well formed and parses its value
+func (c *Condition) prepare() error {
+	kinds := 0
+	for _, set := range []bool{len(c.And) > 0, len(c.Or) > 0, c.Not != nil, c.Attribute != "", c.Event != "" || c.Seen != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("a condition needs exactly one of and, or, not, attribute, event or seen")
+	}
+
+	for _, child := range append(append([]*Condition{}, c.And...), c.Or...) {
+		err := child.prepare()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return c.Not.prepare()
+	}
+	if len(c.And) > 0 || len(c.Or) > 0 {
+		return nil
+	}
+
+	if c.Seen != "" && c.Seen != "first_seen" && c.Seen != "last_seen" {
+		return fmt.Errorf("seen must be first_seen or last_seen, found %q", c.Seen)
+	}
+
+	//attributes compare as strings unless compared with a number
+	if c.Attribute != "" {
+		_, isString := c.Value.(string)
+		switch {
+		case c.Op == "exists":
+			return nil
+		case c.Op == "contains" && !isString:
+			return fmt.Errorf("attribute %q contains needs a string value", c.Attribute)
+		case c.Op == "contains", (c.Op == "=" || c.Op == "!=") && isString:
+			return nil
+		}
+	}
+
+	if _, ok := numericOps[c.Op]; !ok {
+		return fmt.Errorf("unknown op %q", c.Op)
+	}
+
+	number, err := conditionNumber(c.Value, c.Seen != "")
+	if err != nil {
+		return err
+	}
+	c.number = number
+
+	return nil
+}
+
+// numbers as JSON numbers or strings, times also as RFC3339
+func conditionNumber(value interface{}, isTime bool) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		if number, err := strconv.ParseFloat(v, 64); err == nil {
+			return number, nil
+		}
+		if isTime {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				return float64(t.Unix()), nil
+			}
+		}
+	}
+
+	if isTime {
+		return 0, fmt.Errorf("expected a number or RFC3339 time, found %v", value)
+	}
+	return 0, fmt.Errorf("expected a number, found %v", value)
+}
+
+func (c *Condition) Matches(user *models.User) bool {
+	switch {
+	case len(c.And) > 0:
+		for _, child := range c.And {
+			if !child.Matches(user) {
+				return false
+			}
+		}
+		return true
+	case len(c.Or) > 0:
+		for _, child := range c.Or {
+			if child.Matches(user) {
+				return true
+			}
+		}
+		return false
+	case c.Not != nil:
+		return !c.Not.Matches(user)
+	case c.Attribute != "":
+		return c.matchesAttribute(user)
+	case c.Event != "":
+		return c.matchesEvent(user)
+	default:
+		return c.matchesSeen(user.FirstSeen, user.LastSeen)
+	}
+}
+
+func (c *Condition) matchesAttribute(user *models.User) bool {
+	attribute, ok := user.Attributes[c.Attribute]
+	value, isString := c.Value.(string)
+	switch {
+	case c.Op == "exists":
+		return ok
+	case c.Op == "contains":
+		return ok && strings.Contains(attribute.Value, value)
+	case c.Op == "=" && isString:
+		return ok && attribute.Value == value
+	case c.Op == "!=" && isString:
+		return !ok || attribute.Value != value
+	}
+
+	//numeric comparisons only hold for values that are numbers
+	if !ok {
+		return false
+	}
+	number, err := strconv.ParseFloat(attribute.Value, 64)
+	return err == nil && numericOps[c.Op](number, c.number)
+}
+
+// users without the event have a count of 0 and were never seen doing it
+func (c *Condition) matchesEvent(user *models.User) bool {
+	event, ok := user.Events[c.Event]
+	if c.Seen != "" {
+		return ok && c.matchesSeen(event.FirstSeen, event.LastSeen)
+	}
+
+	count := 0
+	if ok {
+		count = event.NumOccurrances
+	}
+	return numericOps[c.Op](float64(count), c.number)
+}
+
+// times that weren't tracked match nothing
+func (c *Condition) matchesSeen(firstSeen, lastSeen int64) bool {
+	seen := firstSeen
+	if c.Seen == "last_seen" {
+		seen = lastSeen
+	}
+
+	return seen != 0 && numericOps[c.Op](float64(seen), c.number)
+}
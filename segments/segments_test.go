@@ -0,0 +1,172 @@
+package segments
+
+import (
+	"encoding/json"
+	"github.com/customerio/homework/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 2019-01-01T00:00:00Z
+const newYear2019 = 1546300800
+
+func testUser() *models.User {
+	return &models.User{
+		ID: 1,
+		Attributes: map[string]*models.Attribute{
+			"city": {Value: "Boston"},
+			"age":  {Value: "34"},
+			"note": {Value: "likes red shoes"},
+		},
+		Events: map[string]*models.Event{
+			"purchase": {Name: "purchase", NumOccurrances: 3, FirstSeen: newYear2019 - 100, LastSeen: newYear2019 + 100},
+		},
+		FirstSeen: newYear2019 - 1000,
+		LastSeen:  newYear2019 + 1000,
+	}
+}
+
+func parseCondition(t *testing.T, text string) *Condition {
+	t.Helper()
+
+	condition := &Condition{}
+	err := json.Unmarshal([]byte(text), condition)
+	if err != nil {
+		t.Fatalf("invalid condition %s: %v", text, err)
+	}
+	err = condition.prepare()
+	if err != nil {
+		t.Fatalf("prepare(%s): %v", text, err)
+	}
+
+	return condition
+}
+
+func TestConditionMatches(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{`{"attribute": "city", "op": "=", "value": "Boston"}`, true},
+		{`{"attribute": "city", "op": "=", "value": "boston"}`, false},
+		{`{"attribute": "city", "op": "!=", "value": "Paris"}`, true},
+		{`{"attribute": "missing", "op": "!=", "value": "Paris"}`, true},
+		{`{"attribute": "city", "op": "exists"}`, true},
+		{`{"attribute": "missing", "op": "exists"}`, false},
+		{`{"attribute": "note", "op": "contains", "value": "red"}`, true},
+		{`{"attribute": "age", "op": ">=", "value": 34}`, true},
+		{`{"attribute": "age", "op": "<", "value": "30"}`, false},
+		{`{"attribute": "city", "op": ">", "value": 1}`, false},
+		{`{"attribute": "missing", "op": "<", "value": 1}`, false},
+		{`{"event": "purchase", "op": ">=", "value": 3}`, true},
+		{`{"event": "purchase", "op": ">", "value": 3}`, false},
+		{`{"event": "refund", "op": "=", "value": 0}`, true},
+		{`{"event": "purchase", "seen": "last_seen", "op": ">", "value": "2019-01-01T00:00:00Z"}`, true},
+		{`{"event": "purchase", "seen": "first_seen", "op": ">", "value": "2019-01-01T00:00:00Z"}`, false},
+		{`{"event": "refund", "seen": "last_seen", "op": "<", "value": "2019-01-01T00:00:00Z"}`, false},
+		{`{"seen": "first_seen", "op": "<", "value": 1546300800}`, true},
+		{`{"seen": "last_seen", "op": "<", "value": 1546300800}`, false},
+		{`{"and": [{"attribute": "city", "op": "exists"}, {"event": "purchase", "op": ">=", "value": 3}]}`, true},
+		{`{"and": [{"attribute": "city", "op": "exists"}, {"event": "purchase", "op": ">=", "value": 4}]}`, false},
+		{`{"or": [{"attribute": "missing", "op": "exists"}, {"event": "purchase", "op": ">=", "value": 3}]}`, true},
+		{`{"or": [{"attribute": "missing", "op": "exists"}, {"event": "refund", "op": ">", "value": 0}]}`, false},
+		{`{"not": {"attribute": "missing", "op": "exists"}}`, true},
+	}
+
+	user := testUser()
+	for _, test := range tests {
+		condition := parseCondition(t, test.condition)
+		if got := condition.Matches(user); got != test.want {
+			t.Errorf("%s matches = %t, want %t", test.condition, got, test.want)
+		}
+	}
+}
+
+func TestConditionMatchesUntrackedTimes(t *testing.T) {
+	user := testUser()
+	user.FirstSeen = 0
+
+	condition := parseCondition(t, `{"seen": "first_seen", "op": "<", "value": 1546300800}`)
+	if condition.Matches(user) {
+		t.Errorf("a first_seen that wasn't tracked matched")
+	}
+}
+
+func TestConditionPrepareErrors(t *testing.T) {
+	tests := []string{
+		`{}`,
+		`{"attribute": "city", "event": "purchase", "op": "=", "value": 1}`,
+		`{"attribute": "city", "op": "~", "value": "Boston"}`,
+		`{"attribute": "city", "op": "contains", "value": 1}`,
+		`{"event": "purchase", "op": ">", "value": "many"}`,
+		`{"seen": "created", "op": "<", "value": 1}`,
+		`{"seen": "first_seen", "op": "<", "value": "yesterday"}`,
+		`{"and": [{"attribute": "city", "op": "exists"}, {"event": "purchase", "op": "?", "value": 1}]}`,
+		`{"not": {}}`,
+	}
+
+	for _, text := range tests {
+		condition := &Condition{}
+		err := json.Unmarshal([]byte(text), condition)
+		if err != nil {
+			t.Fatalf("invalid condition %s: %v", text, err)
+		}
+		if err = condition.prepare(); err == nil {
+			t.Errorf("prepare(%s) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "segments.json")
+	err := os.WriteFile(path, []byte(`{"segments": [
+		{"name": "buyers", "condition": {"event": "purchase", "op": ">=", "value": 1}},
+		{"name": "parisians", "condition": {"attribute": "city", "op": "=", "value": "Paris"}},
+		{"name": "bostonians", "condition": {"attribute": "city", "op": "=", "value": "Boston"}}
+	]}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	definitions, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	got := definitions.Evaluate(testUser())
+	want := []string{"buyers", "bostonians"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Evaluate = %v, want %v", got, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"bad name", `{"segments": [{"name": "a/b", "condition": {"attribute": "city", "op": "exists"}}]}`},
+		{"duplicate name", `{"segments": [
+			{"name": "a", "condition": {"attribute": "city", "op": "exists"}},
+			{"name": "a", "condition": {"attribute": "email", "op": "exists"}}]}`},
+		{"no condition", `{"segments": [{"name": "a"}]}`},
+		{"bad condition", `{"segments": [{"name": "a", "condition": {"op": "exists"}}]}`},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "segments.json")
+			err := os.WriteFile(path, []byte(test.json), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = Load(path); err == nil {
+				t.Errorf("Load(%s) succeeded, want an error", test.json)
+			}
+		})
+	}
+}
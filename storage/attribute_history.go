@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/models"
+	"sort"
+)
+
+// AttributeHistoryEntry is one line of the attribute history NDJSON export
+type AttributeHistoryEntry struct {
+	UserId    int    `json:"user_id"`
+	Attribute string `json:"attribute"`
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// AttributeHistory lists a user's attribute values oldest first, by attribute
+// name.  Attributes without kept history give their current value
+func AttributeHistory(user *models.User) []AttributeHistoryEntry {
+	names := make([]string, 0, len(user.Attributes))
+	for name := range user.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []AttributeHistoryEntry
+	for _, name := range names {
+		attribute := user.Attributes[name]
+		history := attribute.History
+		if len(history) == 0 {
+			history = []models.AttributeValue{{Timestamp: attribute.Timestamp, Value: attribute.Value}}
+		}
+
+		for _, value := range history {
+			entries = append(entries, AttributeHistoryEntry{
+				UserId:    user.ID,
+				Attribute: name,
+				Timestamp: value.Timestamp,
+				Value:     value.Value,
+			})
+		}
+	}
+
+	return entries
+}
+
+// ExportAttributeHistory writes the attribute history of every user in the
+// state store to path, one JSON object per value
+func ExportAttributeHistory(path string) (int, error) {
+	userIds, err := LoadAllUserIds()
+	if err != nil {
+		return 0, err
+	}
+
+	writer, err := OpenReportWriter(path, false)
+	if err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	for _, userId := range userIds {
+		user, err := LoadUserState(userId)
+		if err != nil {
+			_ = writer.Discard()
+			return 0, custom_error.New(fmt.Sprintf("error loading state userId: %d", userId), err)
+		}
+
+		var lines []byte
+		for _, entry := range AttributeHistory(user) {
+			line, err := json.Marshal(&entry)
+			if err != nil {
+				_ = writer.Discard()
+				return 0, custom_error.New("error marshaling attribute history", err)
+			}
+			lines = append(append(lines, line...), '\n')
+			exported++
+		}
+
+		err = writer.WriteUser(userId, string(lines))
+		if err != nil {
+			_ = writer.Discard()
+			return 0, err
+		}
+	}
+
+	return exported, writer.Commit()
+}
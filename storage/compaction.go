@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"errors"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/global"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compactor frees disk space nearing global.DiskBudgetBytes by removing files
+// the run can do without, returning the bytes it freed.  Snapshots are never
+// compacted, they are written wherever they were asked for and aren't counted
+// against the budget
+type Compactor func() int64
+
+// run in order, cheapest and safest first, until usage is back under
+// diskCleanupThreshold
+var compactors = []Compactor{
+	removeStaleTempFiles,
+	removeStaleSpill,
+	removeStaleReportProgress,
+}
+
+// users spilled by this run are still needed, any others are from a run that
+// didn't finish
+var spilling bool
+
+// report checkpoints and parts progress of the writers open in this run
+var openReportProgress = map[string]struct{}{}
+
+// RegisterCompactor adds a compactor, run after those already registered
+func RegisterCompactor(compactor Compactor) {
+	compactors = append(compactors, compactor)
+}
+
+// compactDisk runs the compactors until growing by delta bytes stays under
+// diskCleanupThreshold, returning the bytes freed
+func compactDisk(delta int64) int64 {
+	var freed int64
+	for _, compactor := range compactors {
+		if float64(DiskUsage()+delta) < diskCleanupThreshold*float64(global.DiskBudgetBytes) {
+			break
+		}
+		freed += compactor()
+	}
+
+	return freed
+}
+
+// leftovers from writes that were interrupted before their final rename
+func removeStaleTempFiles() int64 {
+	var freed int64
+	err := filepath.WalkDir(userStateDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tmp") {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		size := allocatedSize(info.Size())
+		releaseDiskUsage(classifyStateFile(path), size)
+		freed += size
+
+		return nil
+	})
+	if err != nil {
+		log.Println(custom_error.New("error removing leftover temp files", err))
+	}
+	if freed > 0 {
+		log.Printf("removed %s of leftover temp files", FormatBytes(freed))
+	}
+
+	return freed
+}
+
+// users spilled by an earlier in-memory run, unless this run spills too
+func removeStaleSpill() int64 {
+	if spilling {
+		return 0
+	}
+
+	before := getDiskUsage()[SpillUsage]
+	err := ClearSpill()
+	if err != nil {
+		log.Println(custom_error.New("error removing stale spilled users", err))
+	}
+
+	freed := before - getDiskUsage()[SpillUsage]
+	if freed > 0 {
+		log.Printf("removed %s of users spilled by an earlier run", FormatBytes(freed))
+	}
+
+	return freed
+}
+
+// checkpoints and parts progress, with their partial files, of reports other
+// than global.ReportFilePath that no writer of this run has open.  Those
+// reports start over if they are written again
+func removeStaleReportProgress() int64 {
+	entries, err := os.ReadDir(userStateDirectory)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println(custom_error.New("error listing report checkpoints", err))
+	}
+
+	//parts, deltas and their checkpoints are all named after the report
+	report := filepath.Base(global.ReportFilePath)
+	reportBase := strings.TrimSuffix(report, filepath.Ext(report))
+
+	var freed int64
+	for _, entry := range entries {
+		//report.<report name>.checkpoint or report.<report name>.parts
+		name := strings.TrimPrefix(entry.Name(), "report.")
+		reportName := strings.TrimSuffix(strings.TrimSuffix(name, reportCheckpointSuffix), reportPartsSuffix)
+		isReportProgress := name != entry.Name() && reportName != name
+		if entry.IsDir() || !isReportProgress || strings.HasPrefix(reportName, reportBase) {
+			continue
+		}
+
+		path := statePath(entry.Name())
+		if _, ok := openReportProgress[path]; ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			log.Println(custom_error.New("error removing "+path, err))
+			continue
+		}
+		releaseDiskUsage(CheckpointUsage, allocatedSize(info.Size()))
+		freed += allocatedSize(info.Size())
+
+		//partial files of other reports aren't tracked, only their
+		//checkpoints are
+		if strings.HasSuffix(name, reportCheckpointSuffix) {
+			_ = os.Remove(filepath.Join(filepath.Dir(global.ReportFilePath), reportName) + partialReportSuffix)
+		}
+	}
+	if freed > 0 {
+		log.Printf("removed %s of progress of unfinished earlier reports", FormatBytes(freed))
+	}
+
+	return freed
+}
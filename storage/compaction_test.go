@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"errors"
+	"github.com/customerio/homework/global"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useDiskBudget compacts against a fresh state directory, spill directory and
+// report under the working directory for the length of the test
+func useDiskBudget(t *testing.T) {
+	t.Helper()
+
+	useStateDirectory(t)
+	useWorkingDirectory(t)
+	previousSpill, previousBudget := SpillDirectory(), global.DiskBudgetBytes
+	SetSpillDirectory(filepath.Join(t.TempDir(), "spill"))
+	t.Cleanup(func() {
+		SetSpillDirectory(previousSpill)
+		global.DiskBudgetBytes = previousBudget
+		spilling = false
+	})
+}
+
+func writeCompactionTestFile(t *testing.T, path string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err == nil {
+		err = os.WriteFile(path, []byte(strings.Repeat("x", 100)), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionFreesWhatTheRunCanDoWithout(t *testing.T) {
+	useDiskBudget(t)
+
+	err := SaveUserState(testUser(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := OpenReportWriter("data/history.txt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = open.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := []string{
+		statePath("2.tmp"),
+		spillPath(5),
+		statePath("report.old.txt" + reportCheckpointSuffix),
+		"data/old.txt" + partialReportSuffix,
+		statePath("report.old.txt" + reportPartsSuffix),
+	}
+	kept := []string{
+		statePath("1"),
+		//the report of this run, resumable, and a report being written
+		statePath("report.output.part-0002.txt" + reportCheckpointSuffix),
+		statePath("report.output.txt" + reportPartsSuffix),
+		reportCheckpointPath("data/history.txt"),
+	}
+	for _, path := range append(removed, kept[1:3]...) {
+		writeCompactionTestFile(t, path)
+	}
+	resetDiskUsage()
+	before := DiskUsage()
+
+	//more than compaction can free, every compactor runs
+	global.DiskBudgetBytes = before
+	err = reserveDiskUsage(StateUsage, before)
+	if !errors.Is(err, ErrDiskBudgetExceeded) {
+		t.Errorf("err = %v, want ErrDiskBudgetExceeded", err)
+	}
+
+	for _, path := range removed {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s wasn't compacted", path)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was compacted: %v", path, err)
+		}
+	}
+	if freed := before - DiskUsage(); freed != 4*diskBlockSize {
+		t.Errorf("freed %d bytes, want %d", freed, 4*diskBlockSize)
+	}
+
+	_ = open.Discard()
+}
+
+func TestCompactionKeepsUsersSpilledByThisRun(t *testing.T) {
+	useDiskBudget(t)
+
+	err := SpillUser(testUser(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetDiskUsage()
+	global.DiskBudgetBytes = DiskUsage()
+
+	_ = reserveDiskUsage(StateUsage, global.DiskBudgetBytes)
+	if _, err := os.Stat(spillPath(5)); err != nil {
+		t.Errorf("user spilled by this run was compacted: %v", err)
+	}
+}
+
+func TestReserveDiskUsageCompactsToMakeRoom(t *testing.T) {
+	useDiskBudget(t)
+
+	writeCompactionTestFile(t, statePath("1.tmp"))
+	writeCompactionTestFile(t, statePath("2.tmp"))
+	resetDiskUsage()
+	global.DiskBudgetBytes = DiskUsage()
+
+	err := reserveDiskUsage(StateUsage, diskBlockSize)
+	if err != nil {
+		t.Errorf("reserveDiskUsage: %v", err)
+	}
+	if got := DiskUsage(); got != diskBlockSize {
+		t.Errorf("usage = %d after compacting, want %d", got, diskBlockSize)
+	}
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/global"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type UsageCategory string
+
+// dedup indexes (event ids) are persisted inside each user's state file,
+// so they are accounted for under StateUsage
+const (
+	StateUsage      UsageCategory = "state"
+	CheckpointUsage UsageCategory = "checkpoint"
+	LogUsage        UsageCategory = "log"
+	SpillUsage      UsageCategory = "spill"
+	ReportUsage     UsageCategory = "report"
+)
+
+// files are allocated on disk in whole blocks, a 300 byte user file still costs 4KB
+const diskBlockSize = 4096
+
+// fraction of global.DiskBudgetBytes at which a warning is logged (once each)
+var diskWarningThresholds = []float64{0.5, 0.75, 0.9}
+
+// fraction of global.DiskBudgetBytes at which the compactors free what they
+// can, once each time usage climbs past it
+const diskCleanupThreshold = 0.95
+
+var ErrDiskBudgetExceeded = errors.New("disk budget exceeded")
+
+var diskUsage map[UsageCategory]int64
+var diskWarningsLogged int
+
+// usage is past diskCleanupThreshold and the compactors already ran
+var diskCleanedUp bool
+
+// DiskUsage returns the total number of bytes currently tracked
+func DiskUsage() int64 {
+	var total int64
+	for _, used := range getDiskUsage() {
+		total += used
+	}
+
+	return total
+}
+
+// reserveDiskUsage checks that growing category by delta bytes stays within
+// global.DiskBudgetBytes and records the change.  Nearing the budget the
+// compactors free what they can first, if the budget would still be exceeded
+// ErrDiskBudgetExceeded is returned and nothing is recorded
+func reserveDiskUsage(category UsageCategory, delta int64) error {
+	if delta <= 0 || global.DiskBudgetBytes <= 0 {
+		releaseDiskUsage(category, -delta)
+		return nil
+	}
+
+	usage := getDiskUsage()
+	projected := DiskUsage() + delta
+	if float64(projected) < diskCleanupThreshold*float64(global.DiskBudgetBytes) {
+		diskCleanedUp = false
+	} else if !diskCleanedUp {
+		//walking the state directory is slow with many users, so only once
+		//per crossing of the threshold
+		diskCleanedUp = true
+		compactDisk(delta)
+		projected = DiskUsage() + delta
+	}
+
+	if projected > global.DiskBudgetBytes {
+		return ErrDiskBudgetExceeded
+	}
+
+	usage[category] += delta
+	logDiskWarnings(projected)
+
+	return nil
+}
+
+// releaseDiskUsage records bytes removed from disk
+func releaseDiskUsage(category UsageCategory, bytes int64) {
+	usage := getDiskUsage()
+	usage[category] -= bytes
+	if usage[category] < 0 {
+		usage[category] = 0
+	}
+}
+
+func logDiskWarnings(used int64) {
+	for diskWarningsLogged < len(diskWarningThresholds) {
+		threshold := diskWarningThresholds[diskWarningsLogged]
+		if float64(used) < threshold*float64(global.DiskBudgetBytes) {
+			return
+		}
+
+		log.Printf("WARNING: disk usage %s has passed %.0f%% of the %s budget",
+			FormatBytes(used), threshold*100, FormatBytes(global.DiskBudgetBytes))
+		diskWarningsLogged++
+	}
+}
+
+// lazily scan what is already on disk, needed when resuming from an interruption
+func getDiskUsage() map[UsageCategory]int64 {
+	if diskUsage != nil {
+		return diskUsage
+	}
+
+	diskUsage = map[UsageCategory]int64{}
+
+	_ = filepath.WalkDir(userStateDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err == nil {
+			diskUsage[classifyStateFile(path)] += allocatedSize(info.Size())
+		}
+
+		return nil
+	})
+
+	//users spilled by an in-memory run
+	_ = filepath.WalkDir(spillDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err == nil {
+			diskUsage[SpillUsage] += allocatedSize(info.Size())
+		}
+
+		return nil
+	})
+
+	for path, category := range outsideStateFiles() {
+		if info, err := os.Stat(path); err == nil {
+			diskUsage[category] += info.Size()
+		}
+	}
+
+	return diskUsage
+}
+
+// outsideStateFiles are the files a run writes outside the state directory,
+// any of which it may later replace or remove and release the size of
+func outsideStateFiles() map[string]UsageCategory {
+	files := map[string]UsageCategory{
+		global.ReportFilePath:    ReportUsage,
+		global.StatsFilePath:     ReportUsage,
+		global.StatsJsonFilePath: ReportUsage,
+		global.TombstoneFilePath: StateUsage,
+		global.AuditLogFilePath:  LogUsage,
+	}
+
+	//report parts, manifests, deltas and their partial files are all named
+	//after the report
+	base := strings.TrimSuffix(global.ReportFilePath, filepath.Ext(global.ReportFilePath))
+	related, _ := filepath.Glob(base + ".*")
+	segments, _ := filepath.Glob(filepath.Join(global.SegmentsDirectory, "*.txt"))
+	for _, path := range append(related, segments...) {
+		files[path] = ReportUsage
+	}
+
+	return files
+}
+
+func resetDiskUsage() {
+	diskUsage = nil
+	diskWarningsLogged = 0
+	diskCleanedUp = false
+}
+
+func classifyStateFile(path string) UsageCategory {
+	relative, err := filepath.Rel(userStateDirectory, path)
+	if err != nil {
+		return StateUsage
+	}
+
+	switch {
+	case strings.HasSuffix(relative, ".log"):
+		return LogUsage
+	case isAuxiliaryStateFile(relative):
+		return CheckpointUsage
+	default:
+		return StateUsage
+	}
+}
+
+func allocatedSize(size int64) int64 {
+	return (size + diskBlockSize - 1) / diskBlockSize * diskBlockSize
+}
+
+// LogDiskUsage prints the per category breakdown of tracked disk usage
+func LogDiskUsage() {
+	usage := getDiskUsage()
+
+	categories := make([]string, 0, len(usage))
+	for category := range usage {
+		categories = append(categories, string(category))
+	}
+	sort.Strings(categories)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("disk usage %s of %s budget",
+		FormatBytes(DiskUsage()), FormatBytes(global.DiskBudgetBytes)))
+	for _, category := range categories {
+		sb.WriteString(fmt.Sprintf("\n  %-10s %s", category, FormatBytes(usage[UsageCategory(category)])))
+	}
+
+	log.Println(sb.String())
+}
+
+// FormatBytes renders a size in binary units, 1536 as 1.5KiB
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseBytes reads a size as plain bytes or with a unit, such as 512MiB, 10GB or 2G.
+// K, M and G are binary units like KiB, MiB and GiB
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(s[:i]), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	multiplier, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, unknown unit %q", s, s[i:])
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
+
+var byteUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1 << 10, "KB": 1000, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1000 * 1000, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1000 * 1000 * 1000, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1000 * 1000 * 1000 * 1000, "TIB": 1 << 40,
+}
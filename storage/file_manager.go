@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"encoding/json"
 	"errors"
 	"github.com/customerio/homework/custom_error"
 	"github.com/customerio/homework/global"
@@ -14,20 +13,36 @@ import (
 	"strings"
 )
 
-const userStateDirectory = "/tmp/go/"
-const resumeMarkerFilePath = userStateDirectory + "marker"
-const offsetMarkerFilePath = userStateDirectory + "offset"
+// where user state and the files kept with it live, always ending in /
+var userStateDirectory = "/tmp/go/"
+
+const resumeMarkerFileName = "marker"
+const offsetMarkerFileName = "offset"
+
+// SetStateDirectory keeps user state, and the files kept with it, in dir
+func SetStateDirectory(dir string) {
+	userStateDirectory = strings.TrimSuffix(dir, "/") + "/"
+}
+
+func StateDirectory() string {
+	return userStateDirectory
+}
+
+// statePath is the path of a file kept in the state directory
+func statePath(name string) string {
+	return userStateDirectory + name
+}
 
 var offsetFileHandle *os.File
-var reportFileHandle *os.File
 
 func DeleteReportFile() error {
-	_, err := os.Stat(global.ReportFilePath)
+	info, err := os.Stat(global.ReportFilePath)
 	if err == nil {
 		err = os.Remove(global.ReportFilePath)
 		if err != nil {
 			return custom_error.New("Error deleting report file", err).Log()
 		}
+		releaseDiskUsage(ReportUsage, info.Size())
 	}
 
 	return nil
@@ -38,6 +53,7 @@ func ClearTempStorage() error {
 	if err != nil {
 		return custom_error.New("Error clearing temp storage dir", err).Log()
 	}
+	resetDiskUsage()
 
 	err = os.Mkdir(userStateDirectory, os.ModePerm)
 	if err != nil {
@@ -47,88 +63,11 @@ func ClearTempStorage() error {
 	return nil
 }
 
-func CheckReportFileExist() bool {
-	_, err := os.Stat(global.ReportFilePath)
-	return err == nil
-}
-
-func AddLineToReport(line string) error {
-	if reportFileHandle == nil {
-		var err error
-		reportFileHandle, err = os.Create(global.ReportFilePath)
-		if err != nil {
-			return custom_error.New("Error creating report file", err).Log()
-		}
-	}
-
-	_, err := reportFileHandle.WriteString(line)
-	if err != nil {
-		return custom_error.New("Error writing to report", err).Log()
-	}
-
-	return nil
-}
-
-func MoveToReportEnd() int {
-	if reportFileHandle != nil {
-		log.Println(custom_error.New("Invalid: attempting to seek end of report when already open", nil))
-		return -1
-	}
-
-	byteArray, err := os.ReadFile(global.ReportFilePath)
-	if err != nil {
-		log.Println(custom_error.New("error reading existing report file", err))
-		return -1
-	}
-
-	var userId int
-	//from end of file walk backwards to find beginning of last line
-	for i := len(byteArray) - 2; i > 0; i-- {
-		if byteArray[i] == '\n' {
-			lastLine := string(byteArray[i+1])
-			indexFirstComma := strings.Index(lastLine, ",")
-			if indexFirstComma < 0 {
-				log.Println("no comma in last line")
-				return -1
-			}
-
-			userId, err = strconv.Atoi(lastLine[0:indexFirstComma])
-			if err != nil {
-				log.Println(custom_error.New("error parsing last userId in report", err))
-			}
-		}
-	}
-
-	reportFileHandle, err = os.OpenFile(global.ReportFilePath, os.O_RDWR, 0666)
-	if err != nil {
-		log.Println(custom_error.New("error opening existing report file", err))
-		return -1
-	}
-	//move file pointer to end of file
-	_, _ = reportFileHandle.Seek(0, 2)
-
-	return userId
-}
-
-func CloseReportFile() error {
-	if reportFileHandle == nil {
-		return custom_error.New("reportFileHandle is nil, unable to close", nil).Log()
-	}
-
-	err := reportFileHandle.Close()
-	reportFileHandle = nil
-	if err != nil {
-		return custom_error.New("Error closing report file", err).Log()
-	}
-
-	return nil
-}
-
 func LoadUserState(userId int) (*models.User, error) {
 	id := strconv.Itoa(userId)
 
 	//open file and read json
-	byteArray, err := os.ReadFile(userStateDirectory + id)
+	byteArray, err := readUserStateFile(userId)
 	if err != nil {
 		//File DNE
 		if errors.Is(err, os.ErrNotExist) {
@@ -142,49 +81,100 @@ func LoadUserState(userId int) (*models.User, error) {
 		return nil, custom_error.New(msg, err).Log()
 	}
 
-	// json -> user
-	user := models.User{}
-	err = json.Unmarshal(byteArray, &user)
+	// json -> user, upgrading state written by older versions
+	user, _, err := decodeUserState(byteArray)
 	if err != nil {
 		return nil, custom_error.New("Error unmarshaling userId "+id, err).Log()
 	}
 
-	if user.Events == nil {
-		user.Events = map[string]*models.Event{}
-	}
+	return user, nil
+}
+
+// ErrUserNotFound is returned for a user there is no state for
+var ErrUserNotFound = errors.New("user not found")
 
-	if user.Attributes == nil {
-		user.Attributes = map[string]*models.Attribute{}
+// LoadExistingUserState loads a user's state like LoadUserState, but returns
+// ErrUserNotFound instead of an empty user when there is none
+func LoadExistingUserState(userId int) (*models.User, error) {
+	_, err := os.Stat(userStateDirectory + strconv.Itoa(userId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, custom_error.New("no state for userId "+strconv.Itoa(userId), ErrUserNotFound)
 	}
 
-	return &user, nil
+	return LoadUserState(userId)
+}
+
+func readUserStateFile(userId int) ([]byte, error) {
+	return os.ReadFile(userStateDirectory + strconv.Itoa(userId))
+}
+
+// checkpoints and markers kept alongside user state
+func isAuxiliaryStateFile(relativePath string) bool {
+	return relativePath == resumeMarkerFileName || relativePath == offsetMarkerFileName ||
+		relativePath == generationFileName || relativePath == ingestCountersFileName || relativePath == ingestSettingsFileName ||
+		relativePath == progressFileName ||
+		strings.HasSuffix(relativePath, reportCheckpointSuffix) || strings.HasSuffix(relativePath, reportPartsSuffix)
+}
+
+// user state files are named by their userId directly in the state directory
+func userIdFromStateFile(relativePath string) (int, bool) {
+	id, err := strconv.Atoi(relativePath)
+	return id, err == nil
 }
 
 func SaveUserState(user *models.User) error {
-	//create and open file
-	fileHandle, err := os.Create(userStateDirectory + strconv.Itoa(user.ID))
+	// user -> versioned json
+	byteArray, err := encodeUserState(user)
 	if err != nil {
-		_ = fileHandle.Close()
-		msg := "Error saving user state for userId: " + strconv.Itoa(user.ID)
+		msg := "Error marshaling user state for userId: " + strconv.Itoa(user.ID)
 		return custom_error.New(msg, err).Log()
 	}
 
-	// user -> json
-	byteArray, err := json.Marshal(user)
+	//account for the size change before anything is written, so running
+	//out of budget leaves the previous state intact
+	filePath := userStateDirectory + strconv.Itoa(user.ID)
+	var previousSize int64
+	if info, err := os.Stat(filePath); err == nil {
+		previousSize = allocatedSize(info.Size())
+	}
+	err = reserveDiskUsage(StateUsage, allocatedSize(int64(len(byteArray)))-previousSize)
 	if err != nil {
-		_ = fileHandle.Close()
-		msg := "Error marshaling user state for userId: " + strconv.Itoa(user.ID)
+		msg := "Error saving user state for userId: " + strconv.Itoa(user.ID)
 		return custom_error.New(msg, err).Log()
 	}
 
-	//save json to file
-	_, err = fileHandle.WriteString(string(byteArray))
-	_ = fileHandle.Close()
+	//save json to a temp file and rename it over the previous state, a kill
+	//mid write must never leave a truncated state file behind
+	tmpFilePath := filePath + ".tmp"
+	err = os.WriteFile(tmpFilePath, byteArray, 0666)
 	if err != nil {
 		msg := "Error writing user state for userId: " + strconv.Itoa(user.ID)
 		return custom_error.New(msg, err).Log()
 	}
 
+	err = os.Rename(tmpFilePath, filePath)
+	if err != nil {
+		msg := "Error replacing user state for userId: " + strconv.Itoa(user.ID)
+		return custom_error.New(msg, err).Log()
+	}
+
+	return nil
+}
+
+// RemoveUserState deletes a user's persisted state, if any
+func RemoveUserState(userId int) error {
+	filePath := userStateDirectory + strconv.Itoa(userId)
+	info, err := os.Stat(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return custom_error.New("Error removing user state for userId: "+strconv.Itoa(userId), err).Log()
+	}
+	releaseDiskUsage(StateUsage, allocatedSize(info.Size()))
+
 	return nil
 }
 
@@ -209,10 +199,11 @@ func LoadAllUserIds() ([]int, error) {
 	}
 
 	//convert from []DirEntry to []int for sorting
-	ids := make([]int, len(dirs))
+	ids := make([]int, 0, len(dirs))
 	for i := 0; i < len(dirs); i++ {
 		//handle hidden files like .DS_Store on MacOS
-		if dirs[i].Name()[0] == '.' || dirs[i].Name() == "marker" || dirs[i].Name() == "offset" {
+		if dirs[i].IsDir() || dirs[i].Name()[0] == '.' || isAuxiliaryStateFile(dirs[i].Name()) ||
+			strings.HasSuffix(dirs[i].Name(), ".tmp") {
 			continue
 		}
 		id, err := strconv.Atoi(dirs[i].Name())
@@ -220,7 +211,7 @@ func LoadAllUserIds() ([]int, error) {
 			log.Println(custom_error.New("error converting "+dirs[i].Name()+" to int", err))
 			continue
 		}
-		ids[i] = id
+		ids = append(ids, id)
 	}
 
 	//sort
@@ -235,7 +226,7 @@ func CreateInterruptedMarkerFile() error {
 		return custom_error.New("error creating temp files directory", err).Log()
 	}
 
-	_, err = os.Create(resumeMarkerFilePath)
+	_, err = os.Create(statePath(resumeMarkerFileName))
 	if err != nil {
 		return custom_error.New("error creating interrupted marker file", err).Log()
 	}
@@ -243,10 +234,21 @@ func CreateInterruptedMarkerFile() error {
 	return nil
 }
 
+// RemoveInterruptedMarkerFile marks the run as complete while keeping the
+// state for later incremental runs
+func RemoveInterruptedMarkerFile() error {
+	err := os.Remove(statePath(resumeMarkerFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return custom_error.New("error removing interrupted marker file", err).Log()
+	}
+
+	return nil
+}
+
 // check for marker file existance to know if we start clean
 // or resume from interruption
 func WasInterrupted() bool {
-	_, err := os.Stat(resumeMarkerFilePath)
+	_, err := os.Stat(statePath(resumeMarkerFileName))
 	//not handling error condition since it will happen every time the file is not found
 	//i.e we werent interrupted
 	return err == nil
@@ -254,17 +256,27 @@ func WasInterrupted() bool {
 
 // used for resume from interruption functionality
 // while building history from records, this saves the offset
-// of the current record so we know where to resume from
-func SetCurrentRecordOffset(offset int64) error {
+// of the current record so we know where to resume from, along with
+// the counters of the records before it
+func SetCurrentRecordOffset(offset int64, counters *IngestCounters) error {
 	if offsetFileHandle == nil {
+		if !CheckRecordOffsetExist() {
+			err := reserveDiskUsage(CheckpointUsage, diskBlockSize)
+			if err != nil {
+				return custom_error.New("error creating offset marker file "+statePath(offsetMarkerFileName), err).Log()
+			}
+		}
+
 		var err error
-		offsetFileHandle, err = os.Create(offsetMarkerFilePath)
+		offsetFileHandle, err = os.Create(statePath(offsetMarkerFileName))
 		if err != nil {
-			return custom_error.New("error creating offset marker file "+offsetMarkerFilePath, err).Log()
+			return custom_error.New("error creating offset marker file "+statePath(offsetMarkerFileName), err).Log()
 		}
 	}
 
-	_, err := offsetFileHandle.WriteAt([]byte(strconv.FormatInt(offset, 10)), 0)
+	//every value only grows, so the line never gets shorter and rewriting it
+	//in place leaves nothing of the previous one behind
+	_, err := offsetFileHandle.WriteAt([]byte(strconv.FormatInt(offset, 10)+" "+counters.format()), 0)
 	if err != nil {
 		return custom_error.New("Error setting current record offset", err).Log()
 	}
@@ -272,39 +284,43 @@ func SetCurrentRecordOffset(offset int64) error {
 	return nil
 }
 
-func GetCurrentRecordOffset() (int64, error) {
-	var byteArray []byte
-	if offsetFileHandle == nil {
-		var err error
-		byteArray, err = os.ReadFile(offsetMarkerFilePath)
-		if err != nil {
-			return 0, custom_error.New("error getting current record offset from ReadFile", err).Log()
-		}
-	} else {
-		_, err := offsetFileHandle.ReadAt(byteArray, 0)
-		if err != nil {
-			return 0, custom_error.New("error seeking to offset 0", err).Log()
-		}
+func GetCurrentRecordOffset() (int64, *IngestCounters, error) {
+	//written through offsetFileHandle when it is open, the file is up to date
+	byteArray, err := os.ReadFile(statePath(offsetMarkerFileName))
+	if err != nil {
+		return 0, nil, custom_error.New("error getting current record offset from ReadFile", err).Log()
 	}
 
-	offset, err := strconv.ParseInt(string(byteArray), 10, 64)
+	//checkpoints from before counters were kept hold only the offset
+	fields := strings.SplitN(string(byteArray), " ", 2)
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
-		return 0, custom_error.New("error parsing current record offset", err).Log()
+		return 0, nil, custom_error.New("error parsing current record offset", err).Log()
+	}
+
+	counters := &IngestCounters{}
+	if len(fields) == 2 {
+		counters, err = parseIngestCounters(fields[1])
+		if err != nil {
+			return 0, nil, custom_error.New("error parsing ingest counters", err).Log()
+		}
 	}
 
-	return offset, nil
+	return offset, counters, nil
 }
 
 func CheckRecordOffsetExist() bool {
-	_, err := os.Stat(offsetMarkerFilePath)
+	_, err := os.Stat(statePath(offsetMarkerFileName))
 	//dont handle err as it occurs every time file exist = false
 	return err == nil
 }
 
 func RemoveOffsetFile() {
 	offsetFileHandle = nil
-	err := os.Remove(offsetMarkerFilePath)
+	err := os.Remove(statePath(offsetMarkerFileName))
 	if err != nil {
 		log.Println(custom_error.New("error deleting offset file", err))
+		return
 	}
+	releaseDiskUsage(CheckpointUsage, diskBlockSize)
 }
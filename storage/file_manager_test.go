@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLoadExistingUserState(t *testing.T) {
+	useStateDirectory(t)
+
+	err := SaveUserState(testUser(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := LoadExistingUserState(1)
+	if err != nil || user.ID != 1 || user.Attributes["email"] == nil {
+		t.Errorf("LoadExistingUserState(1) = %+v, %v", user, err)
+	}
+
+	if _, err = LoadExistingUserState(2); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("err = %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FsckIssue struct {
+	Path   string
+	UserId int
+	Reason string
+}
+
+type FsckResult struct {
+	Checked  int
+	Corrupt  []FsckIssue
+	Orphaned []FsckIssue
+}
+
+// CorruptUserIds lists the users whose state has to be rebuilt
+func (r *FsckResult) CorruptUserIds() []int {
+	ids := make([]int, 0, len(r.Corrupt))
+	for _, issue := range r.Corrupt {
+		ids = append(ids, issue.UserId)
+	}
+
+	return ids
+}
+
+// CheckState scans every file in the state directory, verifying each user's
+// checksum and format version and flagging files no part of the store owns
+func CheckState() (*FsckResult, error) {
+	result := &FsckResult{}
+
+	err := filepath.WalkDir(userStateDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(userStateDirectory, path)
+		if err != nil {
+			return err
+		}
+		result.Checked++
+
+		if userId, ok := userIdFromStateFile(relative); ok {
+			reason := checkUserStateFile(userId)
+			if reason != "" {
+				result.Corrupt = append(result.Corrupt, FsckIssue{Path: relative, UserId: userId, Reason: reason})
+			}
+			return nil
+		}
+
+		reason := checkAuxiliaryFile(relative)
+		if reason != "" {
+			result.Orphaned = append(result.Orphaned, FsckIssue{Path: relative, Reason: reason})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, custom_error.New("error scanning state directory "+userStateDirectory, err).Log()
+	}
+
+	return result, nil
+}
+
+func checkUserStateFile(userId int) string {
+	byteArray, err := readUserStateFile(userId)
+	if err != nil {
+		return err.Error()
+	}
+
+	user, _, err := decodeUserState(byteArray)
+	if err != nil {
+		return err.Error()
+	}
+
+	if user.ID != userId {
+		return fmt.Sprintf("file holds state for userId %d", user.ID)
+	}
+
+	return ""
+}
+
+// returns why a non user file is orphaned, or "" when it belongs to the store
+func checkAuxiliaryFile(relative string) string {
+	switch {
+	case isAuxiliaryStateFile(relative):
+		return ""
+	case strings.HasSuffix(relative, ".tmp"):
+		return "leftover from an interrupted write"
+	default:
+		return "not part of the state store"
+	}
+}
+
+// RemoveOrphans deletes the orphaned files found by CheckState
+func RemoveOrphans(result *FsckResult) error {
+	for _, issue := range result.Orphaned {
+		path := filepath.Join(userStateDirectory, issue.Path)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return custom_error.New("error removing orphaned file "+path, err).Log()
+		}
+		releaseDiskUsage(classifyStateFile(path), allocatedSize(info.Size()))
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/customerio/homework/custom_error"
+	"os"
+	"time"
+)
+
+const generationFileName = "generation"
+
+// Generations number the reports produced from the persisted state.  Users
+// changed by an ingest are stamped with the generation the next report will
+// have, so a delta report emits the users stamped after the last report
+type Generations struct {
+	// generation of the last report of any kind
+	LastGeneration int `json:"last_generation"`
+	// generation and path of the last full report, the base deltas apply to
+	BaseGeneration int    `json:"base_generation"`
+	BaseReport     string `json:"base_report"`
+}
+
+// NextGeneration is the generation being built by the current ingest
+func (g *Generations) NextGeneration() int {
+	return g.LastGeneration + 1
+}
+
+func LoadGenerations() (*Generations, error) {
+	generations := &Generations{}
+
+	byteArray, err := os.ReadFile(statePath(generationFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return generations, nil
+	} else if err != nil {
+		return nil, custom_error.New("error reading "+statePath(generationFileName), err).Log()
+	}
+
+	err = json.Unmarshal(byteArray, generations)
+	if err != nil {
+		return nil, custom_error.New("error parsing "+statePath(generationFileName), err).Log()
+	}
+
+	return generations, nil
+}
+
+// CompleteFullReport records a finished full report as the new delta base
+func CompleteFullReport(reportPath string) (*Generations, error) {
+	generations, err := LoadGenerations()
+	if err != nil {
+		return nil, err
+	}
+
+	generations.LastGeneration = generations.NextGeneration()
+	generations.BaseGeneration = generations.LastGeneration
+	generations.BaseReport = reportPath
+
+	return generations, saveGenerations(generations)
+}
+
+// CompleteDeltaReport records a finished delta report
+func CompleteDeltaReport() (*Generations, error) {
+	generations, err := LoadGenerations()
+	if err != nil {
+		return nil, err
+	}
+
+	generations.LastGeneration = generations.NextGeneration()
+
+	return generations, saveGenerations(generations)
+}
+
+func saveGenerations(generations *Generations) error {
+	byteArray, err := json.Marshal(generations)
+	if err != nil {
+		return custom_error.New("error marshaling generations", err).Log()
+	}
+
+	err = writeFileAtomically(statePath(generationFileName), byteArray)
+	if err != nil {
+		return custom_error.New("error writing "+statePath(generationFileName), err).Log()
+	}
+
+	return nil
+}
+
+// DeltaManifest links a delta report to the full report it applies to
+type DeltaManifest struct {
+	Generation         int       `json:"generation"`
+	PreviousGeneration int       `json:"previous_generation"`
+	BaseGeneration     int       `json:"base_generation"`
+	BaseReport         string    `json:"base_report"`
+	DeltaReport        string    `json:"delta_report"`
+	Format             string    `json:"format"`
+	Added              int       `json:"added"`
+	Changed            int       `json:"changed"`
+	UnchangedOmitted   int       `json:"unchanged_omitted"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+func SaveDeltaManifest(path string, manifest *DeltaManifest) error {
+	byteArray, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return custom_error.New("error marshaling delta manifest", err).Log()
+	}
+	byteArray = append(byteArray, '\n')
+
+	return SaveReportFile(path, byteArray)
+}
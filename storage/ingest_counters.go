@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"os"
+)
+
+const ingestCountersFileName = "ingest"
+
+// IngestCounters describe the records read by every ingest into the state,
+// or by the run when it keeps users in memory
+type IngestCounters struct {
+	Records    int64 `json:"records"`
+	Rejected   int64 `json:"rejected"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+func (c *IngestCounters) format() string {
+	return fmt.Sprintf("%d %d %d", c.Records, c.Rejected, c.Duplicates)
+}
+
+func parseIngestCounters(s string) (*IngestCounters, error) {
+	c := &IngestCounters{}
+	_, err := fmt.Sscanf(s, "%d %d %d", &c.Records, &c.Rejected, &c.Duplicates)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SaveIngestCounters keeps the counters once an ingest has finished, for a
+// report resumed after the offset checkpoint is gone and for later ingests
+func SaveIngestCounters(counters *IngestCounters) error {
+	byteArray, err := json.Marshal(counters)
+	if err != nil {
+		return custom_error.New("error marshaling ingest counters", err).Log()
+	}
+
+	if _, err := os.Stat(statePath(ingestCountersFileName)); errors.Is(err, os.ErrNotExist) {
+		err = reserveDiskUsage(CheckpointUsage, diskBlockSize)
+		if err != nil {
+			return custom_error.New("error writing "+statePath(ingestCountersFileName), err).Log()
+		}
+	}
+
+	err = writeFileAtomically(statePath(ingestCountersFileName), byteArray)
+	if err != nil {
+		return custom_error.New("error writing "+statePath(ingestCountersFileName), err).Log()
+	}
+
+	return nil
+}
+
+// HasIngestCounters reports whether the state holds a finished ingest
+func HasIngestCounters() bool {
+	_, err := os.Stat(statePath(ingestCountersFileName))
+	return err == nil
+}
+
+// LoadIngestCounters returns the counters up to the last finished ingest, all
+// zero when there are none
+func LoadIngestCounters() (*IngestCounters, error) {
+	counters := &IngestCounters{}
+
+	byteArray, err := os.ReadFile(statePath(ingestCountersFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return counters, nil
+	} else if err != nil {
+		return nil, custom_error.New("error reading "+statePath(ingestCountersFileName), err).Log()
+	}
+
+	err = json.Unmarshal(byteArray, counters)
+	if err != nil {
+		return nil, custom_error.New("error parsing "+statePath(ingestCountersFileName), err).Log()
+	}
+
+	return counters, nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"os"
+)
+
+const ingestSettingsFileName = "settings"
+
+// ErrIngestSettingsChanged is returned when state built with one set of
+// ingest settings would be updated with another
+var ErrIngestSettingsChanged = errors.New("ingest settings differ from those the state was built with")
+
+// IngestSettings change what is stored for each record, so every ingest into
+// the same state must use the same ones
+type IngestSettings struct {
+	EventBuckets  string `json:"event_buckets,omitempty"`
+	EventTimezone string `json:"event_timezone,omitempty"`
+	// canonical global.EventAggregations
+	EventAggregations string `json:"event_aggregations,omitempty"`
+	// global.AttributeHistory, "" when no history is kept
+	AttributeHistory string `json:"attribute_history,omitempty"`
+	// global.AsOf, 0 when every record is ingested
+	AsOf int64 `json:"as_of,omitempty"`
+}
+
+// CheckIngestSettings records the settings of the first ingest into the state
+// and refuses different settings after that, clear the state to change them
+func CheckIngestSettings(settings *IngestSettings) error {
+	recorded, err := LoadIngestSettings()
+	if err != nil {
+		return err
+	}
+	if recorded == nil {
+		return saveIngestSettings(settings)
+	}
+
+	if *recorded != *settings {
+		return fmt.Errorf("%w: state has %+v, requested %+v", ErrIngestSettingsChanged, *recorded, *settings)
+	}
+
+	return nil
+}
+
+// LoadIngestSettings returns the settings the state was built with, nil
+// before the first ingest
+func LoadIngestSettings() (*IngestSettings, error) {
+	byteArray, err := os.ReadFile(statePath(ingestSettingsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, custom_error.New("error reading "+statePath(ingestSettingsFileName), err).Log()
+	}
+
+	settings := &IngestSettings{}
+	err = json.Unmarshal(byteArray, settings)
+	if err != nil {
+		return nil, custom_error.New("error parsing "+statePath(ingestSettingsFileName), err).Log()
+	}
+
+	return settings, nil
+}
+
+func saveIngestSettings(settings *IngestSettings) error {
+	byteArray, err := json.Marshal(settings)
+	if err != nil {
+		return custom_error.New("error marshaling ingest settings", err).Log()
+	}
+
+	err = reserveDiskUsage(CheckpointUsage, diskBlockSize)
+	if err != nil {
+		return custom_error.New("error writing "+statePath(ingestSettingsFileName), err).Log()
+	}
+
+	err = writeFileAtomically(statePath(ingestSettingsFileName), byteArray)
+	if err != nil {
+		return custom_error.New("error writing "+statePath(ingestSettingsFileName), err).Log()
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/customerio/homework/custom_error"
+	"os"
+)
+
+const progressFileName = "progress"
+
+// Progress is how far the current, or last, run has got.  It is rewritten as
+// the run goes so other tools can poll it
+type Progress struct {
+	// ingest, report, done, stopped or failed
+	Phase     string `json:"phase"`
+	Pid       int    `json:"pid"`
+	StartedAt int64  `json:"started_at"`
+	UpdatedAt int64  `json:"updated_at"`
+
+	InputFile  string `json:"input_file,omitempty"`
+	InputBytes int64  `json:"input_bytes"`
+	BytesRead  int64  `json:"bytes_read"`
+	Records    int64  `json:"records"`
+	// records read per second by this run, a resumed run doesn't count what
+	// it skipped
+	RecordsPerSecond float64 `json:"records_per_second"`
+	// users first seen by this run, with storage every user in state
+	Users      int64 `json:"users"`
+	Duplicates int64 `json:"duplicates"`
+	Rejected   int64 `json:"rejected"`
+
+	ReportUsers        int64   `json:"report_users"`
+	ReportUsersWritten int64   `json:"report_users_written"`
+	UsersPerSecond     float64 `json:"users_per_second"`
+
+	// seconds until the current phase is done, -1 when unknown
+	EtaSeconds int64 `json:"eta_seconds"`
+}
+
+// SaveProgress replaces the progress file
+func SaveProgress(progress *Progress) error {
+	byteArray, err := json.Marshal(progress)
+	if err != nil {
+		return custom_error.New("error marshaling progress", err)
+	}
+
+	if _, err := os.Stat(statePath(progressFileName)); errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(userStateDirectory, os.ModePerm)
+		if err != nil {
+			return custom_error.New("error creating "+userStateDirectory, err)
+		}
+		err = reserveDiskUsage(CheckpointUsage, diskBlockSize)
+		if err != nil {
+			return custom_error.New("error writing "+statePath(progressFileName), err)
+		}
+	}
+
+	err = writeFileAtomically(statePath(progressFileName), byteArray)
+	if err != nil {
+		return custom_error.New("error writing "+statePath(progressFileName), err)
+	}
+
+	return nil
+}
+
+// LoadProgress returns the progress of the current or last run, nil when
+// there is none
+func LoadProgress() (*Progress, error) {
+	byteArray, err := os.ReadFile(statePath(progressFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, custom_error.New("error reading "+statePath(progressFileName), err)
+	}
+
+	progress := &Progress{}
+	err = json.Unmarshal(byteArray, progress)
+	if err != nil {
+		return nil, custom_error.New("error parsing "+statePath(progressFileName), err)
+	}
+
+	return progress, nil
+}
+
+// ProgressFilePath is where the progress of a run is written
+func ProgressFilePath() string {
+	return statePath(progressFileName)
+}
@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/global"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const partialReportSuffix = ".partial"
+const reportCheckpointSuffix = ".checkpoint"
+
+// ReportWriter writes a report to a partial file next to its final path,
+// durably checkpointing the last completed user every
+// global.ReportCheckpointInterval users.  Resuming truncates anything written
+// after the checkpoint, including a torn last line, and Commit atomically
+// renames the finished report into place
+type ReportWriter struct {
+	path           string
+	partialPath    string
+	checkpointPath string
+
+	file   *os.File
+	writer *bufio.Writer
+
+	checkpoint      reportCheckpoint
+	offset          int64
+	sinceCheckpoint int
+	resumed         bool
+}
+
+type reportCheckpoint struct {
+	// bytes of the partial report known to be complete
+	Offset     int64 `json:"offset"`
+	Users      int   `json:"users"`
+	LastUserId int   `json:"last_user_id"`
+}
+
+// OpenReportWriter starts writing the report at path.  With resume set an
+// existing checkpoint is picked up, otherwise any partial report is discarded
+func OpenReportWriter(path string, resume bool) (*ReportWriter, error) {
+	w := &ReportWriter{
+		path:           path,
+		partialPath:    path + partialReportSuffix,
+		checkpointPath: reportCheckpointPath(path),
+	}
+
+	if resume {
+		err := w.resume()
+		if err != nil {
+			log.Println(custom_error.New("unable to resume "+w.partialPath+", starting over", err))
+		}
+	}
+
+	if !w.resumed {
+		err := w.create()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w.writer = bufio.NewWriter(w.file)
+	openReportProgress[w.checkpointPath] = struct{}{}
+	return w, nil
+}
+
+// checkpoints live with the rest of the state so they are cleared with it
+func reportCheckpointPath(path string) string {
+	return userStateDirectory + "report." + filepath.Base(path) + reportCheckpointSuffix
+}
+
+func (w *ReportWriter) resume() error {
+	byteArray, err := os.ReadFile(w.checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	checkpoint := reportCheckpoint{}
+	err = json.Unmarshal(byteArray, &checkpoint)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.partialPath, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err == nil && info.Size() < checkpoint.Offset {
+		err = custom_error.New("partial report is shorter than its checkpoint", nil)
+	}
+	if err == nil {
+		//drop whatever was written after the checkpoint, including a torn last line
+		err = file.Truncate(checkpoint.Offset)
+	}
+	if err == nil {
+		_, err = file.Seek(checkpoint.Offset, 0)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	releaseDiskUsage(ReportUsage, info.Size()-checkpoint.Offset)
+	w.file = file
+	w.checkpoint = checkpoint
+	w.offset = checkpoint.Offset
+	w.resumed = true
+
+	return nil
+}
+
+func (w *ReportWriter) create() error {
+	if info, err := os.Stat(w.partialPath); err == nil {
+		releaseDiskUsage(ReportUsage, info.Size())
+	}
+	_ = os.Remove(w.checkpointPath)
+
+	err := os.MkdirAll(filepath.Dir(w.partialPath), os.ModePerm)
+	if err != nil {
+		return custom_error.New("Error creating report directory", err).Log()
+	}
+
+	w.file, err = os.Create(w.partialPath)
+	if err != nil {
+		return custom_error.New("Error creating report file", err).Log()
+	}
+
+	return nil
+}
+
+// Resumed reports whether writing continues an interrupted report
+func (w *ReportWriter) Resumed() bool {
+	return w.resumed
+}
+
+// LastUserId returns the last user known to be written, ok is false when
+// no user has been written yet
+func (w *ReportWriter) LastUserId() (userId int, ok bool) {
+	return w.checkpoint.LastUserId, w.checkpoint.Users > 0
+}
+
+// Users returns the number of users written so far
+func (w *ReportWriter) Users() int {
+	return w.checkpoint.Users
+}
+
+// Size returns the bytes written so far
+func (w *ReportWriter) Size() int64 {
+	return w.offset
+}
+
+// WriteHeader writes a line that doesn't belong to any user
+func (w *ReportWriter) WriteHeader(line string) error {
+	return w.write(line)
+}
+
+// WriteUser writes the complete line(s) for userId, users must be written in ascending order
+func (w *ReportWriter) WriteUser(userId int, line string) error {
+	err := w.write(line)
+	if err != nil {
+		return err
+	}
+
+	w.checkpoint.LastUserId = userId
+	w.checkpoint.Users++
+	w.checkpoint.Offset = w.offset
+	w.sinceCheckpoint++
+
+	if w.sinceCheckpoint >= global.ReportCheckpointInterval {
+		return w.Checkpoint()
+	}
+
+	return nil
+}
+
+func (w *ReportWriter) write(line string) error {
+	err := reserveDiskUsage(ReportUsage, int64(len(line)))
+	if err != nil {
+		return custom_error.New("Error writing to report", err).Log()
+	}
+
+	n, err := w.writer.WriteString(line)
+	w.offset += int64(n)
+	if err != nil {
+		return custom_error.New("Error writing to report", err).Log()
+	}
+
+	return nil
+}
+
+// Checkpoint makes everything written so far durable and records it as complete
+func (w *ReportWriter) Checkpoint() error {
+	err := w.writer.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		return custom_error.New("Error syncing report file", err).Log()
+	}
+
+	byteArray, err := json.Marshal(&w.checkpoint)
+	if err != nil {
+		return custom_error.New("Error marshaling report checkpoint", err).Log()
+	}
+
+	err = writeFileAtomically(w.checkpointPath, byteArray)
+	if err != nil {
+		return custom_error.New("Error writing report checkpoint", err).Log()
+	}
+
+	w.sinceCheckpoint = 0
+	return nil
+}
+
+// Commit finishes the report, renaming it over any previous report at its path
+func (w *ReportWriter) Commit() error {
+	delete(openReportProgress, w.checkpointPath)
+	err := w.writer.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	closeErr := w.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return custom_error.New("Error closing report file", err).Log()
+	}
+
+	if info, err := os.Stat(w.path); err == nil {
+		releaseDiskUsage(ReportUsage, info.Size())
+	}
+
+	err = os.Rename(w.partialPath, w.path)
+	if err != nil {
+		return custom_error.New("Error renaming report file to "+w.path, err).Log()
+	}
+
+	err = os.Remove(w.checkpointPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println(custom_error.New("error removing report checkpoint", err))
+	}
+
+	return nil
+}
+
+// Discard abandons the report, removing the partial file and its checkpoint
+func (w *ReportWriter) Discard() error {
+	delete(openReportProgress, w.checkpointPath)
+	closeErr := w.file.Close()
+
+	if info, err := os.Stat(w.partialPath); err == nil {
+		releaseDiskUsage(ReportUsage, info.Size())
+	}
+	err := os.Remove(w.partialPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return custom_error.New("Error removing "+w.partialPath, err).Log()
+	}
+	_ = os.Remove(w.checkpointPath)
+
+	if closeErr != nil {
+		return custom_error.New("Error closing report file", closeErr).Log()
+	}
+
+	return nil
+}
+
+// Close stops writing without committing, checkpointing the progress made
+func (w *ReportWriter) Close() error {
+	delete(openReportProgress, w.checkpointPath)
+	err := w.Checkpoint()
+	closeErr := w.file.Close()
+	if err == nil && closeErr != nil {
+		err = custom_error.New("Error closing report file", closeErr).Log()
+	}
+
+	return err
+}
+
+// SaveReportFile atomically replaces a small output written in one go, such
+// as a manifest, next to the report
+func SaveReportFile(path string, byteArray []byte) error {
+	var previousSize int64
+	if info, err := os.Stat(path); err == nil {
+		previousSize = info.Size()
+	}
+
+	err := reserveDiskUsage(ReportUsage, int64(len(byteArray))-previousSize)
+	if err != nil {
+		return custom_error.New("error writing "+path, err).Log()
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return custom_error.New("error creating directory for "+path, err).Log()
+	}
+
+	err = writeFileAtomically(path, byteArray)
+	if err != nil {
+		return custom_error.New("error writing "+path, err).Log()
+	}
+
+	return nil
+}
+
+// temp file, fsync and rename so path always holds either the old or new content
+func writeFileAtomically(path string, byteArray []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(byteArray)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/customerio/homework/global"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func useCheckpointInterval(t *testing.T, interval int) {
+	t.Helper()
+
+	previous := global.ReportCheckpointInterval
+	global.ReportCheckpointInterval = interval
+	t.Cleanup(func() { global.ReportCheckpointInterval = previous })
+}
+
+func openTestReport(t *testing.T, path string, resume bool) *ReportWriter {
+	t.Helper()
+
+	w, err := OpenReportWriter(path, resume)
+	if err != nil {
+		t.Fatalf("OpenReportWriter: %v", err)
+	}
+
+	return w
+}
+
+func writeTestUsers(t *testing.T, w *ReportWriter, userIds ...int) {
+	t.Helper()
+
+	for _, userId := range userIds {
+		err := w.WriteUser(userId, "user "+strconv.Itoa(userId)+"\n")
+		if err != nil {
+			t.Fatalf("WriteUser(%d): %v", userId, err)
+		}
+	}
+}
+
+func TestReportWriterCheckpoints(t *testing.T) {
+	useStateDirectory(t)
+	useCheckpointInterval(t, 2)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	w := openTestReport(t, path, true)
+	writeTestUsers(t, w, 1, 2, 3)
+
+	//only the first two users have been checkpointed
+	checkpoint := reportCheckpoint{}
+	err := json.Unmarshal([]byte(readTestFile(t, reportCheckpointPath(path))), &checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := reportCheckpoint{Offset: int64(len("user 1\nuser 2\n")), Users: 2, LastUserId: 2}
+	if checkpoint != want {
+		t.Errorf("checkpoint = %+v, want %+v", checkpoint, want)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("report exists before it is committed")
+	}
+
+	err = w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got := readTestFile(t, path); got != "user 1\nuser 2\nuser 3\n" {
+		t.Errorf("report = %q", got)
+	}
+	for _, leftover := range []string{path + partialReportSuffix, reportCheckpointPath(path)} {
+		if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind after commit", leftover)
+		}
+	}
+}
+
+func TestReportWriterResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// written to the partial report after the last checkpoint, as by a
+		// run that was killed
+		torn        string
+		resume      bool
+		wantResumed bool
+		want        string
+	}{
+		{"resumed", "", true, true, "header\nuser 1\nuser 2\nuser 3\n"},
+		{"torn line dropped", "user 3\nus", true, true, "header\nuser 1\nuser 2\nuser 3\n"},
+		{"started over without resume", "", false, false, "header\nuser 3\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useStateDirectory(t)
+			useCheckpointInterval(t, 1000)
+			path := filepath.Join(t.TempDir(), "output.txt")
+
+			w := openTestReport(t, path, true)
+			err := w.WriteHeader("header\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestUsers(t, w, 1, 2)
+			err = w.Close()
+			if err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if test.torn != "" {
+				f, err := os.OpenFile(path+partialReportSuffix, os.O_APPEND|os.O_WRONLY, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = f.WriteString(test.torn)
+				_ = f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w = openTestReport(t, path, test.resume)
+			if w.Resumed() != test.wantResumed {
+				t.Errorf("Resumed() = %t, want %t", w.Resumed(), test.wantResumed)
+			}
+			lastUserId, ok := w.LastUserId()
+			if test.wantResumed && (!ok || lastUserId != 2 || w.Users() != 2) {
+				t.Errorf("LastUserId() = %d, %t with %d users, want 2, true with 2", lastUserId, ok, w.Users())
+			} else if !test.wantResumed && ok {
+				t.Errorf("LastUserId() = %d, true for a new report", lastUserId)
+			}
+
+			if !w.Resumed() {
+				err = w.WriteHeader("header\n")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeTestUsers(t, w, 3)
+			err = w.Commit()
+			if err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			if got := readTestFile(t, path); got != test.want {
+				t.Errorf("report = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReportWriterDiscard(t *testing.T) {
+	useStateDirectory(t)
+	useCheckpointInterval(t, 1)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	err := os.WriteFile(path, []byte("previous report\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := openTestReport(t, path, true)
+	writeTestUsers(t, w, 1, 2)
+	err = w.Discard()
+	if err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+
+	for _, leftover := range []string{path + partialReportSuffix, reportCheckpointPath(path)} {
+		if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind after discard", leftover)
+		}
+	}
+	if got := readTestFile(t, path); got != "previous report\n" {
+		t.Errorf("discard changed the previous report to %q", got)
+	}
+
+	//nothing is left to resume
+	w = openTestReport(t, path, true)
+	if w.Resumed() {
+		t.Errorf("a discarded report was resumed")
+	}
+	_ = w.Discard()
+}
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const reportPartsSuffix = ".parts"
+
+// ReportPart is one finished part file of a partitioned report
+type ReportPart struct {
+	Path        string `json:"path"`
+	FirstUserId int    `json:"first_user_id"`
+	LastUserId  int    `json:"last_user_id"`
+	Users       int    `json:"users"`
+	Lines       int    `json:"lines"`
+	Bytes       int64  `json:"bytes"`
+	Sha256      string `json:"sha256"`
+}
+
+// ReportManifest lists the parts of a partitioned report in user order
+type ReportManifest struct {
+	Report    string       `json:"report"`
+	Parts     []ReportPart `json:"parts"`
+	Users     int          `json:"users"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// reportPartsProgress is kept with the state while a partitioned report is
+// written, so an interrupted one carries on from its last part
+type reportPartsProgress struct {
+	Parts []ReportPart `json:"parts"`
+	//first user of the part being written, set once it has one
+	CurrentFirstUserId int  `json:"current_first_user_id"`
+	CurrentStarted     bool `json:"current_started"`
+}
+
+// PartitionedReportWriter splits a report into numbered part files of at
+// most maxUsers users or, after the user that crosses it, maxBytes bytes.
+// Users are written in ascending order, so the parts stay globally sorted.
+// Each part is written by its own ReportWriter and resumes on its own, and
+// every part starts with the header
+type PartitionedReportWriter struct {
+	path         string
+	progressPath string
+	header       string
+	maxUsers     int
+	maxBytes     int64
+
+	progress reportPartsProgress
+	current  *ReportWriter
+	resumed  bool
+}
+
+// ReportPartPath is the path of part n, data/output.txt part 1 is data/output.part-0001.txt
+func ReportPartPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + fmt.Sprintf(".part-%04d", n) + ext
+}
+
+// ReportManifestPath is where the manifest of a partitioned report is written
+func ReportManifestPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".manifest.json"
+}
+
+// OpenPartitionedReportWriter starts writing the parts of the report at path.
+// With resume set finished parts are kept and the current one carries on from
+// its checkpoint, otherwise parts of any earlier report are removed
+func OpenPartitionedReportWriter(path string, header string, maxUsers int, maxBytes int64, resume bool) (*PartitionedReportWriter, error) {
+	w := &PartitionedReportWriter{
+		path:         path,
+		header:       header,
+		progressPath: userStateDirectory + "report." + filepath.Base(path) + reportPartsSuffix,
+		maxUsers:     maxUsers,
+		maxBytes:     maxBytes,
+	}
+
+	if resume {
+		err := w.loadProgress()
+		if err != nil {
+			log.Println(custom_error.New("unable to resume parts of "+path+", starting over", err))
+			w.progress = reportPartsProgress{}
+		}
+	}
+
+	if !w.resumed {
+		err := w.removeParts()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := w.openPart(resume && w.resumed)
+	if err != nil {
+		return nil, err
+	}
+
+	//interrupted once the part filled up but before it was recorded
+	if w.current.Resumed() && w.currentFull() {
+		err = w.finishPart()
+		if err == nil {
+			err = w.openPart(false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	openReportProgress[w.progressPath] = struct{}{}
+	return w, nil
+}
+
+func (w *PartitionedReportWriter) loadProgress() error {
+	byteArray, err := os.ReadFile(w.progressPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(byteArray, &w.progress)
+	if err != nil {
+		return err
+	}
+
+	//finished parts are only trusted while they are as recorded
+	for _, part := range w.progress.Parts {
+		info, err := os.Stat(part.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			err = commitRecordedPart(part)
+			if err == nil {
+				info, err = os.Stat(part.Path)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if info.Size() != part.Bytes {
+			return fmt.Errorf("%s is %d bytes, expected %d", part.Path, info.Size(), part.Bytes)
+		}
+	}
+
+	w.resumed = true
+	return nil
+}
+
+// removes the parts and manifest of an earlier report, which may have had more parts
+func (w *PartitionedReportWriter) removeParts() error {
+	ext := filepath.Ext(w.path)
+	parts, err := filepath.Glob(strings.TrimSuffix(w.path, ext) + ".part-[0-9]*" + ext)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range append(parts, ReportManifestPath(w.path)) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return custom_error.New("Error removing report part "+path, err).Log()
+		}
+		releaseDiskUsage(ReportUsage, info.Size())
+	}
+
+	_ = os.Remove(w.progressPath)
+	return nil
+}
+
+func (w *PartitionedReportWriter) openPart(resume bool) error {
+	part, err := OpenReportWriter(ReportPartPath(w.path, len(w.progress.Parts)+1), resume)
+	if err != nil {
+		return err
+	}
+	w.current = part
+
+	if !part.Resumed() {
+		w.progress.CurrentStarted = false
+		w.progress.CurrentFirstUserId = 0
+		if w.header != "" {
+			return part.WriteHeader(w.header)
+		}
+	}
+
+	return nil
+}
+
+// Resumed reports whether writing continues an interrupted report
+func (w *PartitionedReportWriter) Resumed() bool {
+	return w.resumed
+}
+
+// LastUserId returns the last user known to be written to any part
+func (w *PartitionedReportWriter) LastUserId() (userId int, ok bool) {
+	if userId, ok := w.current.LastUserId(); ok {
+		return userId, true
+	}
+	if n := len(w.progress.Parts); n > 0 {
+		return w.progress.Parts[n-1].LastUserId, true
+	}
+
+	return 0, false
+}
+
+// WriteUser writes the line(s) for userId, finishing the part once it is full
+func (w *PartitionedReportWriter) WriteUser(userId int, line string) error {
+	if !w.progress.CurrentStarted {
+		w.progress.CurrentStarted = true
+		w.progress.CurrentFirstUserId = userId
+		err := w.saveProgress()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.current.WriteUser(userId, line)
+	if err != nil {
+		return err
+	}
+
+	if !w.currentFull() {
+		return nil
+	}
+
+	err = w.finishPart()
+	if err != nil {
+		return err
+	}
+
+	return w.openPart(false)
+}
+
+func (w *PartitionedReportWriter) currentFull() bool {
+	return (w.maxUsers > 0 && w.current.Users() >= w.maxUsers) ||
+		(w.maxBytes > 0 && w.current.Size() >= w.maxBytes)
+}
+
+// records the current part as finished, then commits it.  Interrupted in
+// between, the part is recorded while still partial and resuming commits it
+func (w *PartitionedReportWriter) finishPart() error {
+	lastUserId, _ := w.current.LastUserId()
+	users := w.current.Users()
+
+	//everything written is durable before it is described
+	err := w.current.Checkpoint()
+	if err != nil {
+		return err
+	}
+
+	part, err := describeReportPart(w.current.partialPath)
+	if err != nil {
+		return custom_error.New("Error reading report part "+w.current.partialPath, err).Log()
+	}
+	part.Path = w.current.path
+	part.FirstUserId = w.progress.CurrentFirstUserId
+	part.LastUserId = lastUserId
+	part.Users = users
+
+	w.progress.Parts = append(w.progress.Parts, *part)
+	w.progress.CurrentStarted = false
+	w.progress.CurrentFirstUserId = 0
+
+	err = w.saveProgress()
+	if err != nil {
+		return err
+	}
+
+	return w.current.Commit()
+}
+
+// commits a part recorded as finished that was interrupted before its
+// partial file was renamed into place
+func commitRecordedPart(part ReportPart) error {
+	err := os.Rename(part.Path+partialReportSuffix, part.Path)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(reportCheckpointPath(part.Path))
+
+	return nil
+}
+
+// line count and checksum are taken from the finished file, so they hold
+// for parts finished across an interruption
+func describeReportPart(path string) (*ReportPart, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	part := &ReportPart{Path: path}
+	hash := sha256.New()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.Read(buf)
+		_, _ = hash.Write(buf[:n])
+		part.Lines += bytes.Count(buf[:n], []byte("\n"))
+		part.Bytes += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	part.Sha256 = hex.EncodeToString(hash.Sum(nil))
+
+	return part, nil
+}
+
+func (w *PartitionedReportWriter) saveProgress() error {
+	byteArray, err := json.Marshal(&w.progress)
+	if err != nil {
+		return custom_error.New("Error marshaling report parts", err).Log()
+	}
+
+	err = writeFileAtomically(w.progressPath, byteArray)
+	if err != nil {
+		return custom_error.New("Error writing report parts "+w.progressPath, err).Log()
+	}
+
+	return nil
+}
+
+// Commit finishes the last part, unless it is empty, and writes the manifest
+func (w *PartitionedReportWriter) Commit() error {
+	delete(openReportProgress, w.progressPath)
+	if w.progress.CurrentStarted || len(w.progress.Parts) == 0 {
+		err := w.finishPart()
+		if err != nil {
+			return err
+		}
+	} else {
+		//the last part filled up exactly, the one opened after it has no users
+		err := w.current.Discard()
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest := &ReportManifest{Report: w.path, Parts: w.progress.Parts, CreatedAt: time.Now().UTC()}
+	for _, part := range w.progress.Parts {
+		manifest.Users += part.Users
+	}
+
+	byteArray, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return custom_error.New("Error marshaling report manifest", err).Log()
+	}
+
+	err = SaveReportFile(ReportManifestPath(w.path), append(byteArray, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(w.progressPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println(custom_error.New("error removing report parts progress", err))
+	}
+
+	return nil
+}
+
+// Close stops writing without committing, checkpointing the current part
+func (w *PartitionedReportWriter) Close() error {
+	delete(openReportProgress, w.progressPath)
+	return w.current.Close()
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func openTestParts(t *testing.T, path string, maxUsers int, maxBytes int64, resume bool) *PartitionedReportWriter {
+	t.Helper()
+
+	w, err := OpenPartitionedReportWriter(path, "header\n", maxUsers, maxBytes, resume)
+	if err != nil {
+		t.Fatalf("OpenPartitionedReportWriter: %v", err)
+	}
+
+	return w
+}
+
+func writeTestPartUsers(t *testing.T, w *PartitionedReportWriter, userIds ...int) {
+	t.Helper()
+
+	for _, userId := range userIds {
+		err := w.WriteUser(userId, "user "+strconv.Itoa(userId)+"\n")
+		if err != nil {
+			t.Fatalf("WriteUser(%d): %v", userId, err)
+		}
+	}
+}
+
+// checkTestParts compares the parts written and their manifest with want,
+// the content of each part
+func checkTestParts(t *testing.T, path string, want ...string) {
+	t.Helper()
+
+	manifest := ReportManifest{}
+	err := json.Unmarshal([]byte(readTestFile(t, ReportManifestPath(path))), &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Parts) != len(want) {
+		t.Fatalf("manifest lists %d parts, want %d", len(manifest.Parts), len(want))
+	}
+
+	users := 0
+	for i, content := range want {
+		partPath := ReportPartPath(path, i+1)
+		if got := readTestFile(t, partPath); got != content {
+			t.Errorf("part %d = %q, want %q", i+1, got, content)
+		}
+		part := manifest.Parts[i]
+		if part.Path != partPath || part.Bytes != int64(len(content)) {
+			t.Errorf("part %d listed as %+v", i+1, part)
+		}
+		users += part.Users
+	}
+	if manifest.Users != users {
+		t.Errorf("manifest counts %d users, its parts %d", manifest.Users, users)
+	}
+
+	if _, err := os.Stat(ReportPartPath(path, len(want)+1)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("an empty part was left after the last one")
+	}
+}
+
+func TestPartitionedReportWriterSplitsByUsers(t *testing.T) {
+	useStateDirectory(t)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	w := openTestParts(t, path, 2, 0, true)
+	writeTestPartUsers(t, w, 1, 2, 3, 4, 5)
+	err := w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	checkTestParts(t, path, "header\nuser 1\nuser 2\n", "header\nuser 3\nuser 4\n", "header\nuser 5\n")
+
+	manifest := ReportManifest{}
+	_ = json.Unmarshal([]byte(readTestFile(t, ReportManifestPath(path))), &manifest)
+	if part := manifest.Parts[1]; part.FirstUserId != 3 || part.LastUserId != 4 || part.Users != 2 || part.Lines != 3 {
+		t.Errorf("part 2 = %+v", part)
+	}
+}
+
+func TestPartitionedReportWriterSplitsByBytes(t *testing.T) {
+	useStateDirectory(t)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	//a part is finished after the user that takes it to 20 bytes
+	w := openTestParts(t, path, 0, 20, true)
+	writeTestPartUsers(t, w, 1, 2, 3, 4)
+	err := w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	checkTestParts(t, path, "header\nuser 1\nuser 2\n", "header\nuser 3\nuser 4\n")
+}
+
+func TestPartitionedReportWriterResume(t *testing.T) {
+	useStateDirectory(t)
+	useCheckpointInterval(t, 1)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	w := openTestParts(t, path, 2, 0, true)
+	writeTestPartUsers(t, w, 1, 2, 3)
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	w = openTestParts(t, path, 2, 0, true)
+	if !w.Resumed() {
+		t.Fatalf("interrupted report wasn't resumed")
+	}
+	if lastUserId, ok := w.LastUserId(); !ok || lastUserId != 3 {
+		t.Errorf("LastUserId() = %d, %t, want 3, true", lastUserId, ok)
+	}
+	writeTestPartUsers(t, w, 4, 5)
+	err = w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	checkTestParts(t, path, "header\nuser 1\nuser 2\n", "header\nuser 3\nuser 4\n", "header\nuser 5\n")
+}
+
+func TestPartitionedReportWriterStartsOver(t *testing.T) {
+	useStateDirectory(t)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	w := openTestParts(t, path, 1, 0, true)
+	writeTestPartUsers(t, w, 1, 2, 3)
+	err := w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a smaller report leaves none of the earlier parts behind
+	w = openTestParts(t, path, 2, 0, false)
+	writeTestPartUsers(t, w, 7)
+	err = w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	checkTestParts(t, path, "header\nuser 7\n")
+}
+
+func TestPartitionedReportWriterResumeCommitsRecordedPart(t *testing.T) {
+	useStateDirectory(t)
+	useCheckpointInterval(t, 1)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	w := openTestParts(t, path, 2, 0, true)
+	writeTestPartUsers(t, w, 1, 2, 3)
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	//interrupted after part 1 was recorded, before it was renamed into place
+	err = os.Rename(ReportPartPath(path, 1), ReportPartPath(path, 1)+partialReportSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestParts(t, path, 2, 0, true)
+	if !w.Resumed() {
+		t.Fatalf("interrupted report wasn't resumed")
+	}
+	writeTestPartUsers(t, w, 4, 5)
+	err = w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	checkTestParts(t, path, "header\nuser 1\nuser 2\n", "header\nuser 3\nuser 4\n", "header\nuser 5\n")
+}
+
+func TestPartitionedReportWriterResumeFinishesFullPart(t *testing.T) {
+	useStateDirectory(t)
+	useCheckpointInterval(t, 1)
+	path := filepath.Join(t.TempDir(), "output.txt")
+
+	//interrupted once part 1 filled up, before it was recorded
+	w := openTestParts(t, path, 3, 0, true)
+	writeTestPartUsers(t, w, 1, 2)
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	w = openTestParts(t, path, 2, 0, true)
+	if lastUserId, ok := w.LastUserId(); !ok || lastUserId != 2 {
+		t.Errorf("LastUserId() = %d, %t, want 2, true", lastUserId, ok)
+	}
+	writeTestPartUsers(t, w, 3)
+	err = w.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	checkTestParts(t, path, "header\nuser 1\nuser 2\n", "header\nuser 3\n")
+}
@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/global"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A snapshot is a newline delimited file:
+//   - a header line describing the snapshot
+//   - one line per file in the state directory (user state and checkpoints)
+//   - a line holding the tombstones of forgotten users, when there are any
+//   - a trailer line holding the sha256 of every preceding byte
+const snapshotFormat = "customerio-homework-snapshot"
+const snapshotVersion = 2
+
+type SnapshotHeader struct {
+	Format        string `json:"format"`
+	Version       int    `json:"version"`
+	CreatedAt     int64  `json:"created_at"`
+	InputFilePath string `json:"input_file"`
+	Entries       int    `json:"entries"`
+}
+
+const tombstonesEntryKind = "tombstones"
+
+type snapshotEntry struct {
+	// empty for files of the state directory
+	Kind string `json:"kind,omitempty"`
+	Path string `json:"path"`
+	Data []byte `json:"data"`
+}
+
+type snapshotTrailer struct {
+	Sha256 string `json:"sha256"`
+}
+
+// ExportSnapshot writes every file of the state directory into a single
+// checksummed snapshot file
+func ExportSnapshot(snapshotPath string) (*SnapshotHeader, error) {
+	paths, err := listStateFiles()
+	if err != nil {
+		return nil, custom_error.New("error listing state files", err).Log()
+	}
+
+	tombstones, err := os.ReadFile(global.TombstoneFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, custom_error.New("error reading tombstones", err).Log()
+	}
+
+	tmpPath := snapshotPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, custom_error.New("error creating snapshot file "+tmpPath, err).Log()
+	}
+
+	header := &SnapshotHeader{
+		Format:        snapshotFormat,
+		Version:       snapshotVersion,
+		CreatedAt:     time.Now().Unix(),
+		InputFilePath: global.InputFilePath,
+		Entries:       len(paths),
+	}
+	if len(tombstones) > 0 {
+		header.Entries++
+	}
+
+	err = writeSnapshot(f, header, paths, tombstones)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, custom_error.New("error writing snapshot file "+tmpPath, err).Log()
+	}
+
+	//only a complete snapshot ever appears under the requested name
+	err = os.Rename(tmpPath, snapshotPath)
+	if err != nil {
+		return nil, custom_error.New("error renaming snapshot file to "+snapshotPath, err).Log()
+	}
+
+	return header, nil
+}
+
+func writeSnapshot(f *os.File, header *SnapshotHeader, paths []string, tombstones []byte) error {
+	checksum := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(f, checksum))
+
+	err := writeSnapshotLine(writer, header)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Join(userStateDirectory, path))
+		if err != nil {
+			return err
+		}
+
+		err = writeSnapshotLine(writer, &snapshotEntry{Path: filepath.ToSlash(path), Data: data})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(tombstones) > 0 {
+		err = writeSnapshotLine(writer, &snapshotEntry{Kind: tombstonesEntryKind, Path: tombstonesEntryKind, Data: tombstones})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	trailer := snapshotTrailer{Sha256: hex.EncodeToString(checksum.Sum(nil))}
+	err = writeSnapshotLine(bufio.NewWriter(f), &trailer)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func writeSnapshotLine(writer *bufio.Writer, value interface{}) error {
+	byteArray, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append(byteArray, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// ImportSnapshot restores a snapshot into the empty state directory.  The
+// whole snapshot is verified before the first file is written
+func ImportSnapshot(snapshotPath string) (*SnapshotHeader, error) {
+	paths, err := listStateFiles()
+	if err != nil {
+		return nil, custom_error.New("error listing state files", err).Log()
+	}
+	if len(paths) > 0 {
+		msg := fmt.Sprintf("state directory %s is not empty (%d files), clear it first", userStateDirectory, len(paths))
+		return nil, custom_error.New(msg, nil).Log()
+	}
+
+	header, err := readSnapshot(snapshotPath, verifySnapshotEntry)
+	if err != nil {
+		return nil, custom_error.New("snapshot failed verification", err).Log()
+	}
+
+	_, err = readSnapshot(snapshotPath, restoreSnapshotEntry)
+	if err != nil {
+		return nil, custom_error.New("error restoring snapshot", err).Log()
+	}
+
+	return header, nil
+}
+
+// readSnapshot walks the snapshot validating header, entries and checksum,
+// calling onEntry for each entry
+func readSnapshot(snapshotPath string, onEntry func(entry *snapshotEntry) error) (*SnapshotHeader, error) {
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		err := f.Close()
+		if err != nil {
+		}
+	}(f)
+
+	reader := bufio.NewReader(f)
+	checksum := sha256.New()
+
+	header := SnapshotHeader{}
+	err = readSnapshotLine(reader, checksum, &header)
+	if err != nil {
+		return nil, custom_error.New("error reading snapshot header", err)
+	}
+	if header.Format != snapshotFormat {
+		return nil, custom_error.New("not a snapshot file: "+snapshotPath, nil)
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		msg := fmt.Sprintf("unsupported snapshot version %d, this build supports up to %d", header.Version, snapshotVersion)
+		return nil, custom_error.New(msg, nil)
+	}
+
+	for i := 0; i < header.Entries; i++ {
+		entry := snapshotEntry{}
+		err = readSnapshotLine(reader, checksum, &entry)
+		if err != nil {
+			return nil, custom_error.New(fmt.Sprintf("error reading snapshot entry %d", i), err)
+		}
+
+		err = validateSnapshotPath(entry.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		err = onEntry(&entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	expected := hex.EncodeToString(checksum.Sum(nil))
+	trailer := snapshotTrailer{}
+	err = readSnapshotLine(reader, nil, &trailer)
+	if err != nil {
+		return nil, custom_error.New("error reading snapshot trailer, snapshot is truncated", err)
+	}
+	if trailer.Sha256 != expected {
+		return nil, custom_error.New("snapshot checksum mismatch, expected "+expected+" found "+trailer.Sha256, nil)
+	}
+
+	if _, err := reader.Peek(1); err != io.EOF {
+		return nil, custom_error.New("unexpected data after snapshot trailer", nil)
+	}
+
+	return &header, nil
+}
+
+func readSnapshotLine(reader *bufio.Reader, checksum hash.Hash, value interface{}) error {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	if checksum != nil {
+		checksum.Write(line)
+	}
+
+	return json.Unmarshal(bytes.TrimSuffix(line, []byte("\n")), value)
+}
+
+// entries may only name files inside the state directory
+func validateSnapshotPath(path string) error {
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+	if path == "" || filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return custom_error.New("invalid path in snapshot: "+path, nil)
+	}
+
+	return nil
+}
+
+// user state must not be newer than this build, older state is upgraded when next loaded
+func verifySnapshotEntry(entry *snapshotEntry) error {
+	if entry.Kind == tombstonesEntryKind {
+		_, err := parseTombstones(entry.Data)
+		return err
+	} else if entry.Kind != "" {
+		return custom_error.New("unknown snapshot entry kind: "+entry.Kind, nil)
+	}
+
+	if _, ok := userIdFromStateFile(entry.Path); !ok {
+		return nil
+	}
+
+	_, _, err := readStateEnvelope(entry.Data)
+	if errors.Is(err, ErrFutureStateVersion) {
+		return custom_error.New("incompatible user state in snapshot: "+entry.Path, err)
+	}
+
+	return nil
+}
+
+func restoreSnapshotEntry(entry *snapshotEntry) error {
+	//merged with any tombstones already recorded on this machine
+	if entry.Kind == tombstonesEntryKind {
+		tombstones, _ := parseTombstones(entry.Data)
+		for _, userId := range tombstones {
+			err := AddTombstone(userId)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path := filepath.Join(userStateDirectory, filepath.FromSlash(entry.Path))
+
+	err := reserveDiskUsage(classifyStateFile(path), allocatedSize(int64(len(entry.Data))))
+	if err != nil {
+		return custom_error.New("error restoring "+entry.Path, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return custom_error.New("error creating directory for "+entry.Path, err)
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, entry.Data, 0666)
+	if err != nil {
+		return custom_error.New("error writing "+tmpPath, err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// relative paths of every file in the state directory, in lexical order.
+// Progress belongs to a single run and isn't state
+func listStateFiles() ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(userStateDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			return err
+		}
+
+		relative, err := filepath.Rel(userStateDirectory, path)
+		if err != nil || relative == progressFileName {
+			return err
+		}
+		paths = append(paths, relative)
+
+		return nil
+	})
+
+	return paths, err
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/customerio/homework/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testUser(id int) *models.User {
+	return &models.User{
+		ID: id,
+		Attributes: map[string]*models.Attribute{
+			"email": {Value: "a@b.com", Timestamp: 10},
+		},
+		Events: map[string]*models.Event{
+			"purchase": {Name: "purchase", Ids: map[string]struct{}{"e1": {}}, NumOccurrances: 1},
+		},
+	}
+}
+
+// useStateDirectory points the state directory at a fresh temporary one for
+// the length of the test
+func useStateDirectory(t *testing.T) {
+	t.Helper()
+
+	previous := StateDirectory()
+	SetStateDirectory(t.TempDir())
+	resetDiskUsage()
+	t.Cleanup(func() {
+		SetStateDirectory(previous)
+		resetDiskUsage()
+	})
+}
+
+// useWorkingDirectory runs the test in a fresh temporary directory, so the
+// tombstones and audit log under data/ are its own
+func useWorkingDirectory(t *testing.T) {
+	t.Helper()
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(previous) })
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+
+	byteArray, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(byteArray)
+}
+
+// exportTestSnapshot saves two users and a tombstone and exports them
+func exportTestSnapshot(t *testing.T) string {
+	t.Helper()
+
+	useStateDirectory(t)
+	useWorkingDirectory(t)
+	for _, userId := range []int{1, 2} {
+		err := SaveUserState(testUser(userId))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := AddTombstone(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	header, err := ExportSnapshot(path)
+	if err != nil {
+		t.Fatalf("ExportSnapshot: %v", err)
+	}
+	if header.Entries != 3 {
+		t.Errorf("exported %d entries, want 3", header.Entries)
+	}
+
+	return path
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := exportTestSnapshot(t)
+
+	//restored into a machine that has never seen the state
+	useStateDirectory(t)
+	useWorkingDirectory(t)
+	_, err := ImportSnapshot(path)
+	if err != nil {
+		t.Fatalf("ImportSnapshot: %v", err)
+	}
+
+	for _, userId := range []int{1, 2} {
+		user, err := LoadUserState(userId)
+		if err != nil {
+			t.Fatalf("LoadUserState(%d): %v", userId, err)
+		}
+		if !reflect.DeepEqual(user, testUser(userId)) {
+			t.Errorf("user %d restored as %+v", userId, user)
+		}
+	}
+
+	tombstones, err := LoadTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tombstones, map[int]struct{}{3: {}}) {
+		t.Errorf("tombstones = %v, want [3]", tombstones)
+	}
+}
+
+func TestImportSnapshotRefusesNonEmptyState(t *testing.T) {
+	path := exportTestSnapshot(t)
+
+	if _, err := ImportSnapshot(path); err == nil {
+		t.Errorf("imported over existing state")
+	}
+}
+
+// rewriteSnapshotLines applies change to every line of the snapshot, keeping
+// the trailer as it was
+func rewriteSnapshotLines(t *testing.T, path string, change func(i int, line []byte) []byte) string {
+	t.Helper()
+
+	byteArray := []byte(readTestFile(t, path))
+	lines := bytes.SplitAfter(byteArray, []byte("\n"))
+	var rewritten []byte
+	for i, line := range lines {
+		rewritten = append(rewritten, change(i, line)...)
+	}
+
+	tamperedPath := path + ".tampered"
+	err := os.WriteFile(tamperedPath, rewritten, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tamperedPath
+}
+
+func TestImportSnapshotRefusesTamperedInput(t *testing.T) {
+	path := exportTestSnapshot(t)
+	lines := strings.Count(readTestFile(t, path), "\n")
+
+	changeEntry := func(i int, line []byte) []byte {
+		if i != 1 {
+			return line
+		}
+		entry := snapshotEntry{}
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Data = bytes.Replace(entry.Data, []byte("a@b.com"), []byte("x@b.com"), 1)
+		changed, err := json.Marshal(&entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(changed, '\n')
+	}
+	escapeEntry := func(i int, line []byte) []byte {
+		return bytes.Replace(line, []byte(`"path":"1"`), []byte(`"path":"../1"`), 1)
+	}
+
+	tests := []struct {
+		name   string
+		change func(i int, line []byte) []byte
+	}{
+		{"entry changed", changeEntry},
+		{"path outside the state directory", escapeEntry},
+		{"truncated", func(i int, line []byte) []byte {
+			if i == lines-1 {
+				return nil
+			}
+			return line
+		}},
+		{"data after the trailer", func(i int, line []byte) []byte {
+			if i == lines-1 {
+				return append(line, "{}\n"...)
+			}
+			return line
+		}},
+		{"not a snapshot", func(i int, line []byte) []byte {
+			return bytes.Replace(line, []byte(snapshotFormat), []byte("something-else"), 1)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tamperedPath := rewriteSnapshotLines(t, path, test.change)
+
+			useStateDirectory(t)
+			useWorkingDirectory(t)
+			if _, err := ImportSnapshot(tamperedPath); err == nil {
+				t.Fatalf("imported a tampered snapshot")
+			}
+
+			//nothing was restored
+			paths, err := listStateFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(paths) > 0 {
+				t.Errorf("a refused import left %v behind", paths)
+			}
+		})
+	}
+}
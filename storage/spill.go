@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/models"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// users evicted from memory by an in-memory run over its memory budget are
+// spilled to a directory of their own, apart from the state kept by storage
+// runs, and are only good for the run that spilled them
+var spillDirectory = filepath.Join(os.TempDir(), "homework-spill")
+
+// SetSpillDirectory spills users evicted from memory to dir
+func SetSpillDirectory(dir string) {
+	spillDirectory = dir
+}
+
+func SpillDirectory() string {
+	return spillDirectory
+}
+
+func spillPath(userId int) string {
+	return filepath.Join(spillDirectory, strconv.Itoa(userId))
+}
+
+// SpillUser writes an evicted user to the spill directory, in the same
+// format as user state, or replaces it there once updated
+func SpillUser(user *models.User) error {
+	byteArray, err := encodeUserState(user)
+	if err != nil {
+		return custom_error.New("Error marshaling spilled userId: "+strconv.Itoa(user.ID), err)
+	}
+
+	filePath := spillPath(user.ID)
+	var previousSize int64
+	if info, err := os.Stat(filePath); err == nil {
+		previousSize = allocatedSize(info.Size())
+	}
+	err = reserveDiskUsage(SpillUsage, allocatedSize(int64(len(byteArray)))-previousSize)
+	if err != nil {
+		return custom_error.New("Error spilling userId: "+strconv.Itoa(user.ID), err)
+	}
+
+	err = os.MkdirAll(spillDirectory, fs.ModePerm)
+	if err != nil {
+		return custom_error.New("Error creating spill dir", err)
+	}
+
+	spilling = true
+	err = os.WriteFile(filePath, byteArray, 0666)
+	if err != nil {
+		return custom_error.New("Error writing spilled userId: "+strconv.Itoa(user.ID), err)
+	}
+
+	return nil
+}
+
+// LoadSpilledUser reads a user back from the spill directory
+func LoadSpilledUser(userId int) (*models.User, error) {
+	byteArray, err := os.ReadFile(spillPath(userId))
+	if err != nil {
+		return nil, custom_error.New("Error reading spilled userId: "+strconv.Itoa(userId), err)
+	}
+
+	user, _, err := decodeUserState(byteArray)
+	if err != nil {
+		return nil, custom_error.New("Error unmarshaling spilled userId: "+strconv.Itoa(userId), err)
+	}
+
+	return user, nil
+}
+
+// RemoveSpilledUser deletes a user read back into memory
+func RemoveSpilledUser(userId int) error {
+	filePath := spillPath(userId)
+	info, err := os.Stat(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	err = os.Remove(filePath)
+	if err != nil {
+		return custom_error.New("Error removing spilled userId: "+strconv.Itoa(userId), err)
+	}
+	releaseDiskUsage(SpillUsage, allocatedSize(info.Size()))
+
+	return nil
+}
+
+// LoadSpilledUserIds lists the spilled users, numerically sorted
+func LoadSpilledUserIds() ([]int, error) {
+	entries, err := os.ReadDir(spillDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return []int{}, nil
+	} else if err != nil {
+		return nil, custom_error.New("error listing spill dir", err)
+	}
+
+	ids := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids, nil
+}
+
+// ClearSpill removes every spilled user
+func ClearSpill() error {
+	var freed int64
+	entries, err := os.ReadDir(spillDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			freed += allocatedSize(info.Size())
+		}
+	}
+
+	err = os.RemoveAll(spillDirectory)
+	if err != nil {
+		return custom_error.New("Error clearing spill dir", err)
+	}
+	releaseDiskUsage(SpillUsage, freed)
+	spilling = false
+
+	return nil
+}
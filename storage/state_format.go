@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/models"
+	"hash/crc32"
+	"log"
+)
+
+// CurrentStateVersion is the format version written with every persisted user.
+// Bump it whenever models.User, models.Event or models.Attribute change in a
+// way older state can't be read as-is (new fields whose zero value is correct
+// don't need it) and register a Migration from the previous version
+const CurrentStateVersion = 2
+
+// from this version on every persisted user carries a checksum
+const checksummedStateVersion = 2
+
+var ErrFutureStateVersion = errors.New("state was written by a newer version")
+var ErrCorruptState = errors.New("state is corrupt")
+
+var stateChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Migration upgrades a persisted user payload from one version to the next
+type Migration func(payload json.RawMessage) (json.RawMessage, error)
+
+// keyed by the version being migrated from
+var migrations = map[int]Migration{
+	0: migrateUntaggedState,
+	1: migrateUncheckedState,
+}
+
+// every persisted user is wrapped in an envelope carrying its format version
+// and a checksum of the user payload
+type stateEnvelope struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum,omitempty"`
+	User     json.RawMessage `json:"user"`
+}
+
+// RegisterMigration adds the migration upgrading state from version from to from+1
+func RegisterMigration(from int, migration Migration) {
+	migrations[from] = migration
+}
+
+func encodeUserState(user *models.User) ([]byte, error) {
+	payload, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&stateEnvelope{
+		Version:  CurrentStateVersion,
+		Checksum: stateChecksum(payload),
+		User:     payload,
+	})
+}
+
+func stateChecksum(payload []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(payload, stateChecksumTable))
+}
+
+// decodeUserState reads a persisted user of any known version, upgrading it
+// to CurrentStateVersion.  The version found on disk is returned as well
+func decodeUserState(byteArray []byte) (*models.User, int, error) {
+	version, payload, err := readStateEnvelope(byteArray)
+	if err != nil {
+		return nil, version, err
+	}
+
+	payload, err = migrateState(version, payload)
+	if err != nil {
+		return nil, version, err
+	}
+
+	user := models.User{}
+	err = json.Unmarshal(payload, &user)
+	if err != nil {
+		return nil, version, custom_error.New(err.Error(), ErrCorruptState)
+	}
+
+	if user.Events == nil {
+		user.Events = map[string]*models.Event{}
+	}
+
+	if user.Attributes == nil {
+		user.Attributes = map[string]*models.Attribute{}
+	}
+
+	return &user, version, nil
+}
+
+func readStateEnvelope(byteArray []byte) (int, json.RawMessage, error) {
+	envelope := stateEnvelope{}
+	err := json.Unmarshal(byteArray, &envelope)
+	if err != nil {
+		return 0, nil, custom_error.New("unreadable state", ErrCorruptState)
+	}
+
+	//state written before versioning is the bare models.User json
+	if envelope.User == nil {
+		return 0, byteArray, nil
+	}
+
+	if envelope.Version > CurrentStateVersion {
+		msg := fmt.Sprintf("found version %d, this build supports up to %d", envelope.Version, CurrentStateVersion)
+		return envelope.Version, nil, custom_error.New(msg, ErrFutureStateVersion)
+	}
+
+	//state written before checksums were required may not have one to verify
+	if envelope.Checksum == "" && envelope.Version >= checksummedStateVersion {
+		return envelope.Version, nil, custom_error.New("checksum missing", ErrCorruptState)
+	}
+	if envelope.Checksum != "" && envelope.Checksum != stateChecksum(envelope.User) {
+		return envelope.Version, nil, custom_error.New("checksum mismatch", ErrCorruptState)
+	}
+
+	return envelope.Version, envelope.User, nil
+}
+
+func migrateState(version int, payload json.RawMessage) (json.RawMessage, error) {
+	for ; version < CurrentStateVersion; version++ {
+		migration, ok := migrations[version]
+		if !ok {
+			return nil, custom_error.New(fmt.Sprintf("no migration registered from state version %d", version), nil)
+		}
+
+		var err error
+		payload, err = migration(payload)
+		if err != nil {
+			return nil, custom_error.New(fmt.Sprintf("error migrating state from version %d", version), err)
+		}
+	}
+
+	return payload, nil
+}
+
+// version 1 only added the envelope, the payload itself is unchanged
+func migrateUntaggedState(payload json.RawMessage) (json.RawMessage, error) {
+	return payload, nil
+}
+
+// version 2 requires the checksum version 1 could leave out.  The payload is
+// unchanged, the checksum is added when the migrated user is saved
+func migrateUncheckedState(payload json.RawMessage) (json.RawMessage, error) {
+	return payload, nil
+}
+
+type MigrationResult struct {
+	Migrated int
+	Current  int
+	Failed   int
+}
+
+// MigrateAllUserStates rewrites every persisted user older than
+// CurrentStateVersion.  Nothing is rewritten if any user was written by a
+// newer version
+func MigrateAllUserStates() (*MigrationResult, error) {
+	userIds, err := LoadAllUserIds()
+	if err != nil {
+		return nil, err
+	}
+
+	//refuse up front rather than leaving a half migrated state directory
+	for _, userId := range userIds {
+		byteArray, err := readUserStateFile(userId)
+		if err != nil {
+			continue
+		}
+		_, _, err = readStateEnvelope(byteArray)
+		if errors.Is(err, ErrFutureStateVersion) {
+			return nil, custom_error.New(fmt.Sprintf("userId %d", userId), err).Log()
+		}
+	}
+
+	result := &MigrationResult{}
+	for _, userId := range userIds {
+		byteArray, err := readUserStateFile(userId)
+		if err != nil {
+			log.Println(custom_error.New(fmt.Sprintf("error reading state for userId %d", userId), err))
+			result.Failed++
+			continue
+		}
+
+		user, version, err := decodeUserState(byteArray)
+		if err != nil {
+			log.Println(custom_error.New(fmt.Sprintf("error migrating state for userId %d", userId), err))
+			result.Failed++
+			continue
+		}
+
+		if version == CurrentStateVersion {
+			result.Current++
+			continue
+		}
+
+		err = SaveUserState(user)
+		if err != nil {
+			result.Failed++
+			continue
+		}
+		result.Migrated++
+	}
+
+	return result, nil
+}
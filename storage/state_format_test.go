@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDecodeUserStateVersions(t *testing.T) {
+	user := testUser(7)
+	bare, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := encodeUserState(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchecked, err := json.Marshal(&stateEnvelope{Version: 1, User: bare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checked, err := json.Marshal(&stateEnvelope{Version: 1, Checksum: stateChecksum(bare), User: bare})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		state       []byte
+		wantVersion int
+	}{
+		{"current", current, CurrentStateVersion},
+		{"untagged, before versioning", bare, 0},
+		{"version 1 without a checksum", unchecked, 1},
+		{"version 1 with a checksum", checked, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, version, err := decodeUserState(test.state)
+			if err != nil {
+				t.Fatalf("decodeUserState: %v", err)
+			}
+			if version != test.wantVersion {
+				t.Errorf("version = %d, want %d", version, test.wantVersion)
+			}
+			if !reflect.DeepEqual(decoded, user) {
+				t.Errorf("decoded %+v, want %+v", decoded, user)
+			}
+		})
+	}
+}
+
+func TestDecodeUserStateFutureVersion(t *testing.T) {
+	state, err := json.Marshal(&stateEnvelope{Version: CurrentStateVersion + 1, User: json.RawMessage(`{"ID": 1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, version, err := decodeUserState(state)
+	if !errors.Is(err, ErrFutureStateVersion) {
+		t.Errorf("err = %v, want ErrFutureStateVersion", err)
+	}
+	if version != CurrentStateVersion+1 {
+		t.Errorf("version = %d, want %d", version, CurrentStateVersion+1)
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	payload := json.RawMessage(`{"ID": 1}`)
+
+	tests := []struct {
+		name    string
+		version int
+		wantErr bool
+	}{
+		{"current needs nothing", CurrentStateVersion, false},
+		{"untagged", 0, false},
+		{"version 1", 1, false},
+		{"no migration registered", -1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migrated, err := migrateState(test.version, payload)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("migrateState(%d) error = %v, want error %t", test.version, err, test.wantErr)
+			}
+			if err == nil && string(migrated) != string(payload) {
+				t.Errorf("migrateState(%d) = %s, want %s", test.version, migrated, payload)
+			}
+		})
+	}
+}
+
+func TestMigrateStateRunsRegisteredMigrations(t *testing.T) {
+	previous := migrations[0]
+	t.Cleanup(func() { migrations[0] = previous })
+
+	var from []int
+	RegisterMigration(0, func(payload json.RawMessage) (json.RawMessage, error) {
+		from = append(from, 0)
+		return json.RawMessage(`{"ID": 2}`), nil
+	})
+
+	migrated, err := migrateState(0, json.RawMessage(`{"ID": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(migrated) != `{"ID": 2}` || !reflect.DeepEqual(from, []int{0}) {
+		t.Errorf("migrateState = %s after migrations from %v", migrated, from)
+	}
+
+	RegisterMigration(0, func(payload json.RawMessage) (json.RawMessage, error) {
+		return nil, errors.New("broken")
+	})
+	if _, err = migrateState(0, json.RawMessage(`{"ID": 1}`)); err == nil {
+		t.Errorf("a failing migration succeeded")
+	}
+}
+
+func TestMigrateAllUserStates(t *testing.T) {
+	useStateDirectory(t)
+
+	bare, err := json.Marshal(testUser(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := encodeUserState(testUser(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bareUser4, err := json.Marshal(testUser(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchecked, err := json.Marshal(&stateEnvelope{Version: 1, User: bareUser4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[int][]byte{1: bare, 2: current, 3: []byte("{not json"), 4: unchecked}
+	for userId, state := range files {
+		err = os.WriteFile(statePath(strconv.Itoa(userId)), state, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := MigrateAllUserStates()
+	if err != nil {
+		t.Fatalf("MigrateAllUserStates: %v", err)
+	}
+	want := MigrationResult{Migrated: 2, Current: 1, Failed: 1}
+	if *result != want {
+		t.Errorf("result = %+v, want %+v", *result, want)
+	}
+
+	for _, userId := range []int{1, 4} {
+		byteArray, err := readUserStateFile(userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, version, err := decodeUserState(byteArray); err != nil || version != CurrentStateVersion {
+			t.Errorf("migrated user %d decoded as version %d, err %v", userId, version, err)
+		}
+		envelope := stateEnvelope{}
+		if err = json.Unmarshal(byteArray, &envelope); err != nil || envelope.Checksum == "" {
+			t.Errorf("migrated user %d has no checksum", userId)
+		}
+	}
+}
+
+func TestMigrateAllUserStatesRefusesFutureVersions(t *testing.T) {
+	useStateDirectory(t)
+
+	bare, err := json.Marshal(testUser(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	future, err := json.Marshal(&stateEnvelope{Version: CurrentStateVersion + 1, User: json.RawMessage(`{"ID": 2}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for userId, state := range map[int][]byte{1: bare, 2: future} {
+		err = os.WriteFile(statePath(strconv.Itoa(userId)), state, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = MigrateAllUserStates()
+	if !errors.Is(err, ErrFutureStateVersion) {
+		t.Fatalf("err = %v, want ErrFutureStateVersion", err)
+	}
+
+	byteArray, err := readUserStateFile(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(byteArray) != string(bare) {
+		t.Errorf("user 1 was rewritten despite the refusal")
+	}
+}
+
+func TestDecodeUserStateRejectsCorruption(t *testing.T) {
+	current, err := encodeUserState(testUser(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := stateEnvelope{}
+	err = json.Unmarshal(current, &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := envelope
+	tampered.User = json.RawMessage(strings.Replace(string(envelope.User), "a@b.com", "x@b.com", 1))
+	tamperedState, err := json.Marshal(&tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongChecksum := envelope
+	wrongChecksum.Checksum = "00000000"
+	wrongChecksumState, err := json.Marshal(&wrongChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a checksum can only be left out by versions before it was required
+	noChecksum := envelope
+	noChecksum.Checksum = ""
+	noChecksumState, err := json.Marshal(&noChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		state []byte
+	}{
+		{"payload changed", tamperedState},
+		{"checksum changed", wrongChecksumState},
+		{"checksum missing", noChecksumState},
+		{"truncated", current[:len(current)/2]},
+		{"empty", []byte{}},
+		{"not json", []byte("garbage")},
+		{"payload of the wrong shape", []byte(`{"version": 1, "user": {"ID": "seven"}}`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := decodeUserState(test.state)
+			if !errors.Is(err, ErrCorruptState) {
+				t.Errorf("err = %v, want ErrCorruptState", err)
+			}
+		})
+	}
+}
+
+func TestCheckStateFindsCorruptUsers(t *testing.T) {
+	useStateDirectory(t)
+
+	err := SaveUserState(testUser(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveUserState(testUser(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byteArray, err := readUserStateFile(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(statePath("2"), []byte(strings.Replace(string(byteArray), "a@b.com", "x@b.com", 1)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CheckState()
+	if err != nil {
+		t.Fatalf("CheckState: %v", err)
+	}
+	if got := result.CorruptUserIds(); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("corrupt users = %v, want [2]", got)
+	}
+	if _, err = LoadUserState(1); err != nil {
+		t.Errorf("LoadUserState(1): %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// Status describes what the state directory holds
+type Status struct {
+	StateDirectory string `json:"state_directory"`
+	// a run was stopped, the next one resumes it
+	Interrupted bool `json:"interrupted"`
+	// an ingest was stopped at IngestOffset, counted up to there in Ingest
+	IngestInProgress bool  `json:"ingest_in_progress"`
+	IngestOffset     int64 `json:"ingest_offset,omitempty"`
+	// counters of every ingest, up to the one in progress or the last finished
+	Ingest      *IngestCounters `json:"ingest,omitempty"`
+	Settings    *IngestSettings `json:"settings,omitempty"`
+	Generations *Generations    `json:"generations"`
+	Users       int             `json:"users"`
+	// the run going on, or the last one
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+func LoadStatus() (*Status, error) {
+	status := &Status{StateDirectory: userStateDirectory, Generations: &Generations{}}
+	_, err := os.Stat(userStateDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return status, nil
+	}
+
+	status.Interrupted = WasInterrupted()
+	if CheckRecordOffsetExist() {
+		status.IngestInProgress = true
+		status.IngestOffset, status.Ingest, err = GetCurrentRecordOffset()
+		if err != nil {
+			return nil, err
+		}
+	} else if HasIngestCounters() {
+		status.Ingest, err = LoadIngestCounters()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status.Progress, err = LoadProgress()
+	if err != nil {
+		return nil, err
+	}
+
+	status.Settings, err = LoadIngestSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	status.Generations, err = LoadGenerations()
+	if err != nil {
+		return nil, err
+	}
+
+	userIds, err := LoadAllUserIds()
+	if err != nil {
+		return nil, err
+	}
+	status.Users = len(userIds)
+
+	return status, nil
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/customerio/homework/custom_error"
+	"github.com/customerio/homework/global"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuditEntry struct {
+	Time         string `json:"time"`
+	Action       string `json:"action"`
+	UserId       int    `json:"user_id"`
+	StateRemoved bool   `json:"state_removed"`
+}
+
+// ForgetUser erases a user's state and records a tombstone so later ingests
+// and reports skip them.  The tombstone is made durable before anything is
+// removed, a crash part way through can't resurrect the user
+func ForgetUser(userId int) (*AuditEntry, error) {
+	err := AddTombstone(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, statErr := os.Stat(userStateDirectory + strconv.Itoa(userId))
+	err = RemoveUserState(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &AuditEntry{
+		Time:         time.Now().UTC().Format(time.RFC3339),
+		Action:       "forget",
+		UserId:       userId,
+		StateRemoved: statErr == nil,
+	}
+
+	err = appendAuditLog(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// LoadTombstones returns the ids of every forgotten user
+func LoadTombstones() (map[int]struct{}, error) {
+	tombstones := map[int]struct{}{}
+
+	f, err := os.Open(global.TombstoneFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return tombstones, nil
+	} else if err != nil {
+		return nil, custom_error.New("error opening tombstone file "+global.TombstoneFilePath, err).Log()
+	}
+	defer func(f *os.File) {
+		err := f.Close()
+		if err != nil {
+		}
+	}(f)
+
+	byteArray, err := io.ReadAll(f)
+	if err != nil {
+		return nil, custom_error.New("error reading tombstone file "+global.TombstoneFilePath, err).Log()
+	}
+
+	userIds, err := parseTombstones(byteArray)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, userId := range userIds {
+		tombstones[userId] = struct{}{}
+	}
+
+	return tombstones, nil
+}
+
+// one userId per line
+func parseTombstones(byteArray []byte) ([]int, error) {
+	var userIds []int
+	for _, line := range strings.Split(string(byteArray), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		userId, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, custom_error.New("error parsing tombstone "+line, err).Log()
+		}
+		userIds = append(userIds, userId)
+	}
+
+	return userIds, nil
+}
+
+func AddTombstone(userId int) error {
+	tombstones, err := LoadTombstones()
+	if err != nil {
+		return err
+	}
+	if _, ok := tombstones[userId]; ok {
+		return nil
+	}
+
+	return appendDurably(global.TombstoneFilePath, StateUsage, strconv.Itoa(userId)+"\n")
+}
+
+func appendAuditLog(entry *AuditEntry) error {
+	byteArray, err := json.Marshal(entry)
+	if err != nil {
+		return custom_error.New("error marshaling audit entry", err).Log()
+	}
+
+	return appendDurably(global.AuditLogFilePath, LogUsage, string(byteArray)+"\n")
+}
+
+// appendDurably appends line to path and syncs it to disk before returning
+func appendDurably(path string, category UsageCategory, line string) error {
+	err := reserveDiskUsage(category, int64(len(line)))
+	if err != nil {
+		return custom_error.New("error appending to "+path, err).Log()
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return custom_error.New("error creating directory for "+path, err).Log()
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return custom_error.New("error opening "+path, err).Log()
+	}
+
+	_, err = f.WriteString(line)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return custom_error.New(fmt.Sprintf("error appending to %s", path), err).Log()
+	}
+
+	return nil
+}
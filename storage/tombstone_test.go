@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForgetUser(t *testing.T) {
+	useStateDirectory(t)
+	useWorkingDirectory(t)
+
+	err := SaveUserState(testUser(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := ForgetUser(1)
+	if err != nil {
+		t.Fatalf("ForgetUser(1): %v", err)
+	}
+	if entry.UserId != 1 || entry.Action != "forget" || !entry.StateRemoved {
+		t.Errorf("audit entry = %+v", entry)
+	}
+	if _, err := os.Stat(statePath("1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state of a forgotten user left behind")
+	}
+
+	//forgetting a user without state, or again, still leaves a record
+	for _, userId := range []int{2, 1} {
+		entry, err = ForgetUser(userId)
+		if err != nil {
+			t.Fatalf("ForgetUser(%d): %v", userId, err)
+		}
+		if entry.StateRemoved {
+			t.Errorf("user %d had no state to remove", userId)
+		}
+	}
+
+	tombstones, err := LoadTombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tombstones, map[int]struct{}{1: {}, 2: {}}) {
+		t.Errorf("tombstones = %v, want [1 2]", tombstones)
+	}
+
+	lines := strings.Split(strings.TrimSpace(readTestFile(t, "data/audit.log")), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d audit entries, want 3", len(lines))
+	}
+	for _, line := range lines {
+		if err := json.Unmarshal([]byte(line), &AuditEntry{}); err != nil {
+			t.Errorf("audit entry %s: %v", line, err)
+		}
+	}
+}
+
+func TestLoadTombstonesRejectsGarbage(t *testing.T) {
+	useWorkingDirectory(t)
+
+	err := os.Mkdir("data", os.ModePerm)
+	if err == nil {
+		err = os.WriteFile("data/tombstones", []byte("1\nseven\n"), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = LoadTombstones(); err == nil {
+		t.Errorf("LoadTombstones read a tombstone that isn't a user id")
+	}
+}
@@ -2,13 +2,14 @@ package stream
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/customerio/homework/custom_error"
 	"github.com/customerio/homework/global"
 	"github.com/customerio/homework/models"
 	"io"
-	"log"
 	"os"
 	"strconv"
 )
@@ -21,15 +22,41 @@ const (
 )
 
 type Record struct {
-	ID        string            `json:"id"`
-	Type      RecordType        `json:"type"`
-	Name      string            `json:"name"`
-	UserID    string            `json:"user_id"`
-	Data      map[string]string `json:"data"`
-	Timestamp int64             `json:"timestamp"`
+	ID        string                     `json:"id"`
+	Type      RecordType                 `json:"type"`
+	Name      string                     `json:"name"`
+	UserID    string                     `json:"user_id"`
+	Data      map[string]json.RawMessage `json:"data"`
+	Timestamp int64                      `json:"timestamp"`
 
 	// Position in the input stream where this record lives.
 	Position int64 `json:"-"`
+
+	// Err is set when the line couldn't be parsed, the rest of the record is empty
+	Err error `json:"-"`
+}
+
+// DataValue is an event data field as text.  Numbers and booleans are kept
+// as written, so {"price": 12.50} and {"price": "12.50"} read the same
+type DataValue string
+
+func (v *DataValue) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*v = ""
+		return nil
+	}
+	if data[0] != '"' {
+		if data[0] == '{' || data[0] == '[' {
+			return fmt.Errorf("data value must be a string, number or boolean, found %s", data)
+		}
+		*v = DataValue(data)
+		return nil
+	}
+
+	var s string
+	err := json.Unmarshal(data, &s)
+	*v = DataValue(s)
+	return err
 }
 
 // Process returns a channel to which a stream of records are sent. Reading starts at
@@ -55,9 +82,9 @@ func process(ctx context.Context, f io.ReadSeeker) (<-chan *Record, error) {
 			rec := &Record{
 				Position: offset,
 			}
+			//unparseable lines are still sent so they can be counted as rejected
 			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
-				log.Println("json.Unmarshal failed", err)
-				continue
+				rec = &Record{Position: offset, Err: err}
 			}
 			select {
 			case _ = <-ctx.Done():
@@ -85,6 +112,8 @@ func GetRecords(ctx context.Context) (<-chan *Record, error) {
 	return ch, nil
 }
 
+// Map turns a record into a user history.  Attribute values must be strings
+// while event data may also be numbers or booleans, see DataValue
 func Map(rec *Record) (*models.UserHistory, error) {
 	userId, err := strconv.Atoi(rec.UserID)
 	if err != nil {
@@ -94,11 +123,17 @@ func Map(rec *Record) (*models.UserHistory, error) {
 	userHistory := models.UserHistory{
 		UserId:     userId,
 		Attributes: map[string]*models.Attribute{},
+		Timestamp:  rec.Timestamp,
 	}
 
 	if rec.Type == Attributes {
 		userHistory.HistoryType = models.AttributeType
-		for key, value := range rec.Data {
+		for key, raw := range rec.Data {
+			var value string
+			err = json.Unmarshal(raw, &value)
+			if err != nil {
+				return nil, fmt.Errorf("attribute %s must be a string, found %s", key, raw)
+			}
 			attribute := models.Attribute{
 				Value:     value,
 				Timestamp: rec.Timestamp}
@@ -108,9 +143,23 @@ func Map(rec *Record) (*models.UserHistory, error) {
 
 	} else if rec.Type == Event {
 		userHistory.HistoryType = models.EventType
-		userHistory.Event = &models.Event{Name: rec.Name, Ids: map[string]struct{}{}}
+		userHistory.Event = &models.Event{
+			Name:      rec.Name,
+			Ids:       map[string]struct{}{},
+			FirstSeen: rec.Timestamp,
+			LastSeen:  rec.Timestamp,
+		}
 		userHistory.Event.Ids[rec.ID] = struct{}{}
 		userHistory.Event.NumOccurrances = 1
+		userHistory.EventData = make(map[string]string, len(rec.Data))
+		for key, raw := range rec.Data {
+			var value DataValue
+			err = json.Unmarshal(raw, &value)
+			if err != nil {
+				return nil, fmt.Errorf("event data %s: %w", key, err)
+			}
+			userHistory.EventData[key] = string(value)
+		}
 	}
 
 	return &userHistory, nil
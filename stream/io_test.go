@@ -0,0 +1,85 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestProcess(t *testing.T) {
+	input := `{"id": "a1", "type": "attributes", "user_id": "1", "data": {"email": "a@b.com"}, "timestamp": 10}` + "\n" +
+		"not json\n" +
+		`{"id": "e1", "type": "event", "name": "login", "user_id": "1", "data": {}, "timestamp": 11}` + "\n"
+
+	ch, err := process(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*Record
+	for rec := range ch {
+		records = append(records, rec)
+	}
+	if len(records) != 3 {
+		t.Fatalf("%d records, want 3", len(records))
+	}
+
+	//each record is positioned at the end of its line, where a resumed run carries on
+	lines := strings.SplitAfter(input, "\n")
+	position := int64(0)
+	for i, rec := range records {
+		position += int64(len(lines[i]))
+		if rec.Position != position {
+			t.Errorf("record %d at %d, want %d", i, rec.Position, position)
+		}
+	}
+	if records[1].Err == nil || records[0].Err != nil || records[2].Name != "login" {
+		t.Errorf("records = %+v %+v %+v", records[0], records[1], records[2])
+	}
+}
+
+func TestMap(t *testing.T) {
+	rec := &Record{
+		ID:        "e1",
+		Type:      Event,
+		Name:      "purchase",
+		UserID:    "7",
+		Data:      map[string]json.RawMessage{"price": json.RawMessage(`12.50`), "coupon": json.RawMessage(`"SPRING"`), "gift": json.RawMessage(`true`), "note": json.RawMessage(`null`)},
+		Timestamp: 100,
+	}
+
+	userHistory, err := Map(rec)
+	if err != nil {
+		t.Fatalf("Map: %v", err)
+	}
+	if userHistory.UserId != 7 || userHistory.Event.Name != "purchase" || userHistory.Event.NumOccurrances != 1 ||
+		userHistory.Event.FirstSeen != 100 || userHistory.Event.LastSeen != 100 {
+		t.Errorf("event = %+v", userHistory.Event)
+	}
+	want := map[string]string{"price": "12.50", "coupon": "SPRING", "gift": "true", "note": ""}
+	for key, value := range want {
+		if userHistory.EventData[key] != value {
+			t.Errorf("EventData[%s] = %q, want %q", key, userHistory.EventData[key], value)
+		}
+	}
+}
+
+func TestMapErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rec  *Record
+	}{
+		{"user_id not a number", &Record{Type: Attributes, UserID: "seven"}},
+		{"attribute not a string", &Record{Type: Attributes, UserID: "7", Data: map[string]json.RawMessage{"age": json.RawMessage(`34`)}}},
+		{"event data an object", &Record{Type: Event, UserID: "7", Data: map[string]json.RawMessage{"item": json.RawMessage(`{"sku": 1}`)}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Map(test.rec); err == nil {
+				t.Errorf("Map(%+v) succeeded, want an error", test.rec)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package user_history
+
+import (
+	"fmt"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Aggregation is one func(event.field) of global.EventAggregations
+type Aggregation struct {
+	Func  string
+	Event string
+	Field string
+}
+
+// Name is how the aggregation is reported, purchase.price.sum
+func (a Aggregation) Name() string {
+	return a.Event + "." + a.Field + "." + a.Func
+}
+
+// Value returns the aggregated value, ok is false when no occurrence had
+// a numeric value for the field
+func (a Aggregation) Value(event *models.Event) (value float64, ok bool) {
+	aggregate, ok := event.Aggregates[a.Field]
+	if !ok || aggregate.Count == 0 {
+		return 0, false
+	}
+
+	switch a.Func {
+	case "sum":
+		return aggregate.Sum, true
+	case "min":
+		return aggregate.Min, true
+	case "max":
+		return aggregate.Max, true
+	default:
+		return aggregate.Sum / float64(aggregate.Count), true
+	}
+}
+
+var aggregationPattern = regexp.MustCompile(`^(sum|min|max|avg)\(([^.()]+)\.([^()]+)\)$`)
+
+// parsed once from global.EventAggregations
+var aggregations []Aggregation
+var aggregationsParsed bool
+
+// ParseAggregations parses a comma separated list such as
+// "sum(purchase.price),avg(order.items)"
+func ParseAggregations(spec string) ([]Aggregation, error) {
+	var parsed []Aggregation
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		match := aggregationPattern.FindStringSubmatch(part)
+		if match == nil {
+			return nil, fmt.Errorf("invalid aggregation %q, expected sum, min, max or avg of event.field", part)
+		}
+		parsed = append(parsed, Aggregation{Func: match[1], Event: match[2], Field: match[3]})
+	}
+
+	return parsed, nil
+}
+
+// CheckEventAggregations validates global.EventAggregations
+func CheckEventAggregations() error {
+	parsed, err := ParseAggregations(global.EventAggregations)
+	if err != nil {
+		return err
+	}
+	aggregations, aggregationsParsed = parsed, true
+
+	return nil
+}
+
+// EventAggregations returns the configured aggregations in the order given
+func EventAggregations() []Aggregation {
+	if !aggregationsParsed {
+		//CheckEventAggregations has rejected a bad spec before any ingest
+		aggregations, _ = ParseAggregations(global.EventAggregations)
+		aggregationsParsed = true
+	}
+
+	return aggregations
+}
+
+// aggregatedValues returns the numeric values of the fields aggregated for
+// the event, nil when it has none
+func aggregatedValues(userHistory *models.UserHistory) map[string]float64 {
+	var values map[string]float64
+	for _, aggregation := range EventAggregations() {
+		if aggregation.Event != userHistory.Event.Name {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(userHistory.EventData[aggregation.Field], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		if values == nil {
+			values = map[string]float64{}
+		}
+		values[aggregation.Field] = value
+	}
+
+	return values
+}
+
+func addToAggregates(event *models.Event, values map[string]float64) {
+	for field, value := range values {
+		if event.Aggregates == nil {
+			event.Aggregates = map[string]*models.Aggregate{}
+		}
+
+		aggregate, ok := event.Aggregates[field]
+		if !ok {
+			event.Aggregates[field] = &models.Aggregate{Count: 1, Sum: value, Min: value, Max: value}
+			continue
+		}
+
+		aggregate.Count++
+		aggregate.Sum += value
+		aggregate.Min = math.Min(aggregate.Min, value)
+		aggregate.Max = math.Max(aggregate.Max, value)
+	}
+}
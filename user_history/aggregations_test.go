@@ -0,0 +1,88 @@
+package user_history
+
+import (
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"reflect"
+	"testing"
+)
+
+// useEventAggregations aggregates spec for the length of the test
+func useEventAggregations(t *testing.T, spec string) {
+	t.Helper()
+
+	previous := global.EventAggregations
+	global.EventAggregations = spec
+	t.Cleanup(func() {
+		global.EventAggregations = previous
+		aggregations, aggregationsParsed = nil, false
+	})
+
+	err := CheckEventAggregations()
+	if err != nil {
+		t.Fatalf("CheckEventAggregations: %v", err)
+	}
+}
+
+func TestParseAggregations(t *testing.T) {
+	got, err := ParseAggregations(" sum(purchase.price), avg(order.items),")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Aggregation{{"sum", "purchase", "price"}, {"avg", "order", "items"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAggregations = %v, want %v", got, want)
+	}
+
+	for _, spec := range []string{"count(purchase.price)", "sum(price)", "sum(purchase.price"} {
+		if _, err := ParseAggregations(spec); err == nil {
+			t.Errorf("ParseAggregations(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestCreateHistoriesAggregatesEvents(t *testing.T) {
+	useMemory(t)
+	useEventAggregations(t, "sum(purchase.price),min(purchase.price),max(purchase.price),avg(purchase.price),sum(refund.price)")
+
+	users := createTestHistories(t,
+		eventRecord(1, "e1", "purchase", 10, map[string]string{"price": "12.5"}),
+		eventRecord(1, "e2", "purchase", 20, map[string]string{"price": `"7.5"`}),
+		//duplicates, missing and non-numeric values aren't counted
+		eventRecord(1, "e2", "purchase", 20, map[string]string{"price": "7.5"}),
+		eventRecord(1, "e3", "purchase", 30, map[string]string{"price": `"free"`}),
+		eventRecord(1, "e4", "purchase", 40, nil),
+		eventRecord(1, "e5", "purchase", 50, map[string]string{"price": "4"}),
+		eventRecord(1, "e6", "refund", 60, map[string]string{"amount": "4"}),
+	)
+
+	purchase := users[1].Events["purchase"]
+	want := &models.Aggregate{Count: 3, Sum: 24, Min: 4, Max: 12.5}
+	if got := purchase.Aggregates["price"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("purchase.price = %+v, want %+v", got, want)
+	}
+
+	values := map[string]float64{}
+	for _, aggregation := range EventAggregations() {
+		if aggregation.Event != "purchase" {
+			continue
+		}
+		value, ok := aggregation.Value(purchase)
+		if !ok {
+			t.Errorf("%s has no value", aggregation.Name())
+		}
+		values[aggregation.Name()] = value
+	}
+	wantValues := map[string]float64{
+		"purchase.price.sum": 24, "purchase.price.min": 4, "purchase.price.max": 12.5, "purchase.price.avg": 8,
+	}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("values = %v, want %v", values, wantValues)
+	}
+
+	//a refund never had a price
+	refundPrice := Aggregation{"sum", "refund", "price"}
+	if _, ok := refundPrice.Value(users[1].Events["refund"]); ok {
+		t.Errorf("%s has a value without any prices", refundPrice.Name())
+	}
+}
@@ -0,0 +1,59 @@
+package user_history
+
+import (
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"sort"
+)
+
+// addToHistory records value as set at timestamp, keeping the newest
+// global.AttributeHistory values, or all of them when it is negative.
+// Returns whether the history changed
+func addToHistory(attribute *models.Attribute, timestamp int64, value string) bool {
+	limit := global.AttributeHistory
+	if limit == 0 {
+		return false
+	}
+
+	history := attribute.History
+	//after any values with the same timestamp, so the order seen breaks ties
+	i := sort.Search(len(history), func(i int) bool { return history[i].Timestamp > timestamp })
+	for j := i - 1; j >= 0 && history[j].Timestamp == timestamp; j-- {
+		if history[j].Value == value {
+			return false
+		}
+	}
+
+	//older than every value kept in a full history
+	if limit > 0 && len(history) >= limit && i == 0 {
+		return false
+	}
+
+	history = append(history, models.AttributeValue{})
+	copy(history[i+1:], history[i:])
+	history[i] = models.AttributeValue{Timestamp: timestamp, Value: value}
+
+	if limit > 0 && len(history) > limit {
+		history = append([]models.AttributeValue(nil), history[len(history)-limit:]...)
+	}
+	attribute.History = history
+
+	return true
+}
+
+// ValueAt returns the value the attribute had at timestamp and when it was
+// set.  Without kept history only the current value is known.  ok is false
+// when it wasn't set yet or the history doesn't go back that far
+func ValueAt(attribute *models.Attribute, timestamp int64) (value models.AttributeValue, ok bool) {
+	history := attribute.History
+	if len(history) == 0 {
+		history = []models.AttributeValue{{Timestamp: attribute.Timestamp, Value: attribute.Value}}
+	}
+
+	i := sort.Search(len(history), func(i int) bool { return history[i].Timestamp > timestamp })
+	if i == 0 {
+		return models.AttributeValue{}, false
+	}
+
+	return history[i-1], true
+}
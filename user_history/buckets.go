@@ -0,0 +1,57 @@
+package user_history
+
+import (
+	"fmt"
+	"github.com/customerio/homework/global"
+	"time"
+)
+
+// bucket labels sort in time order: 2015-04-03, 2015-W14, 2015-04
+var bucketLabels = map[string]func(t time.Time) string{
+	"day": func(t time.Time) string { return t.Format("2006-01-02") },
+	"week": func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	},
+	"month": func(t time.Time) string { return t.Format("2006-01") },
+}
+
+// loaded once, LoadLocation reads the zone database on every call
+var bucketLocation *time.Location
+
+// CheckEventBuckets validates global.EventBuckets and global.EventTimezone
+func CheckEventBuckets() error {
+	if global.EventBuckets == "" {
+		return nil
+	}
+	if _, ok := bucketLabels[global.EventBuckets]; !ok {
+		return fmt.Errorf("unknown event bucket %q, expected day, week or month", global.EventBuckets)
+	}
+
+	location, err := time.LoadLocation(global.EventTimezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q: %w", global.EventTimezone, err)
+	}
+	bucketLocation = location
+
+	return nil
+}
+
+// eventBucket returns the label of the bucket a record timestamp falls in,
+// "" when events aren't bucketed
+func eventBucket(timestamp int64) string {
+	label, ok := bucketLabels[global.EventBuckets]
+	if !ok {
+		return ""
+	}
+	if bucketLocation == nil {
+		//CheckEventBuckets has rejected a bad timezone before any ingest
+		location, err := time.LoadLocation(global.EventTimezone)
+		if err != nil {
+			location = time.UTC
+		}
+		bucketLocation = location
+	}
+
+	return label(time.Unix(timestamp, 0).In(bucketLocation))
+}
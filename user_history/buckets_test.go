@@ -0,0 +1,110 @@
+package user_history
+
+import (
+	"github.com/customerio/homework/global"
+	"testing"
+)
+
+// useEventBuckets buckets events by bucket in timezone for the length of the
+// test
+func useEventBuckets(t *testing.T, bucket, timezone string) {
+	t.Helper()
+
+	previousBuckets, previousTimezone := global.EventBuckets, global.EventTimezone
+	global.EventBuckets, global.EventTimezone = bucket, timezone
+	t.Cleanup(func() {
+		global.EventBuckets, global.EventTimezone = previousBuckets, previousTimezone
+		bucketLocation = nil
+	})
+
+	err := CheckEventBuckets()
+	if err != nil {
+		t.Fatalf("CheckEventBuckets: %v", err)
+	}
+}
+
+func TestEventBucket(t *testing.T) {
+	// 2019-12-31T23:30:00Z, a Tuesday in ISO week 1 of 2020
+	const newYearsEve = 1577835000
+
+	tests := []struct {
+		bucket   string
+		timezone string
+		want     string
+	}{
+		{"day", "UTC", "2019-12-31"},
+		{"day", "Europe/Paris", "2020-01-01"},
+		{"day", "America/New_York", "2019-12-31"},
+		{"week", "UTC", "2020-W01"},
+		{"week", "Pacific/Kiritimati", "2020-W01"},
+		{"month", "UTC", "2019-12"},
+		{"month", "Asia/Tokyo", "2020-01"},
+		{"month", "America/Los_Angeles", "2019-12"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bucket+" "+test.timezone, func(t *testing.T) {
+			useEventBuckets(t, test.bucket, test.timezone)
+			if got := eventBucket(newYearsEve); got != test.want {
+				t.Errorf("eventBucket = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventBucketWeekBoundary(t *testing.T) {
+	useEventBuckets(t, "week", "America/New_York")
+
+	// 2020-01-06T04:59:59Z and 05:00:00Z, either side of Monday midnight in New York
+	if got := eventBucket(1578286799); got != "2020-W01" {
+		t.Errorf("Sunday night = %q, want 2020-W01", got)
+	}
+	if got := eventBucket(1578286800); got != "2020-W02" {
+		t.Errorf("Monday midnight = %q, want 2020-W02", got)
+	}
+}
+
+func TestEventBucketUnbucketed(t *testing.T) {
+	useEventBuckets(t, "", "UTC")
+	if got := eventBucket(1577835000); got != "" {
+		t.Errorf("eventBucket = %q without buckets", got)
+	}
+}
+
+func TestCheckEventBucketsErrors(t *testing.T) {
+	tests := []struct {
+		bucket   string
+		timezone string
+	}{
+		{"hour", "UTC"},
+		{"day", "Mars/Olympus_Mons"},
+	}
+
+	for _, test := range tests {
+		previousBuckets, previousTimezone := global.EventBuckets, global.EventTimezone
+		global.EventBuckets, global.EventTimezone = test.bucket, test.timezone
+		err := CheckEventBuckets()
+		global.EventBuckets, global.EventTimezone = previousBuckets, previousTimezone
+		if err == nil {
+			t.Errorf("CheckEventBuckets(%s, %s) succeeded, want an error", test.bucket, test.timezone)
+		}
+	}
+}
+
+func TestCreateHistoriesBucketsEvents(t *testing.T) {
+	useMemory(t)
+	useEventBuckets(t, "day", "Europe/Paris")
+
+	// 22:30 and 23:30 UTC on 2019-12-31, the second is new year's day in Paris
+	users := createTestHistories(t,
+		eventRecord(1, "e1", "purchase", 1577831400, nil),
+		eventRecord(1, "e2", "purchase", 1577835000, nil),
+		eventRecord(1, "e2", "purchase", 1577835000, nil),
+	)
+
+	want := map[string]int{"2019-12-31": 1, "2020-01-01": 1}
+	got := users[1].Events["purchase"].Buckets
+	if len(got) != len(want) || got["2019-12-31"] != 1 || got["2020-01-01"] != 1 {
+		t.Errorf("buckets = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,166 @@
+package user_history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/customerio/homework/storage"
+	"github.com/customerio/homework/stream"
+	"io"
+	"math"
+	"os"
+)
+
+// bytes of input read to estimate the rest of it from
+const estimateSampleBytes = 4 * 1024 * 1024
+
+// rough bytes the in-memory users take beyond the names, values and ids
+// they hold, from the layout of the models and their maps
+const (
+	userOverheadBytes      = 400 // a User, its map entry and its two maps
+	attributeOverheadBytes = 120 // an Attribute and its map entry
+	eventOverheadBytes     = 250 // an Event, its Ids map and its map entry
+	eventIdOverheadBytes   = 64  // an Ids map entry and its string header
+	// the heap grows to about twice what is live before it is collected
+	heapGrowthFactor = 2
+)
+
+// Estimate projects the size of an input, and of the users it holds kept in
+// memory, from a sample at its start
+type Estimate struct {
+	FileBytes      int64
+	SampledBytes   int64
+	SampledRecords int64
+	// the sample was the whole input, so the counts are exact
+	Exact bool
+
+	Records        int64
+	Users          int64
+	FootprintBytes int64
+}
+
+func (e *Estimate) String() string {
+	approximately := "~"
+	if e.Exact {
+		approximately = ""
+	}
+
+	return fmt.Sprintf("%s%d users, %s%d records, %s%s in memory (sampled %d records, %s of %s)",
+		approximately, e.Users, approximately, e.Records, approximately, storage.FormatBytes(e.FootprintBytes),
+		e.SampledRecords, storage.FormatBytes(e.SampledBytes), storage.FormatBytes(e.FileBytes))
+}
+
+// EstimateInput samples the input at path, projecting the records from its
+// size and the users from how often the sample saw the same users again
+func EstimateInput(path string) (*Estimate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	estimate := &Estimate{FileBytes: info.Size()}
+
+	//what the sampled users hold
+	users := map[string]struct{}{}
+	attributes := map[string]struct{}{}
+	events := map[string]struct{}{}
+	eventIds := map[string]struct{}{}
+	var attributeBytes, eventBytes, eventIdBytes int64
+
+	reader := bufio.NewReader(f)
+	for estimate.SampledBytes < estimateSampleBytes {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		estimate.SampledBytes += int64(len(line))
+		if len(line) > 0 {
+			estimate.SampledRecords++
+
+			rec := &stream.Record{}
+			if json.Unmarshal(line, rec) == nil && rec.UserID != "" {
+				users[rec.UserID] = struct{}{}
+				if rec.Type == stream.Attributes {
+					for name, value := range rec.Data {
+						key := rec.UserID + "\x00" + name
+						if _, ok := attributes[key]; !ok {
+							attributes[key] = struct{}{}
+							attributeBytes += int64(len(name) + len(value))
+						}
+					}
+				} else if rec.Type == stream.Event {
+					key := rec.UserID + "\x00" + rec.Name
+					if _, ok := events[key]; !ok {
+						events[key] = struct{}{}
+						eventBytes += int64(len(rec.Name))
+					}
+					if _, ok := eventIds[rec.ID]; !ok {
+						eventIds[rec.ID] = struct{}{}
+						eventIdBytes += int64(len(rec.ID))
+					}
+				}
+			}
+		}
+
+		if err == io.EOF {
+			estimate.Exact = true
+			break
+		}
+	}
+
+	//users and what each of them holds grow with the users, event ids with
+	//the records
+	perUser := int64(len(users))*userOverheadBytes +
+		int64(len(attributes))*attributeOverheadBytes + attributeBytes +
+		int64(len(events))*eventOverheadBytes + eventBytes
+	perRecord := int64(len(eventIds))*eventIdOverheadBytes + eventIdBytes
+
+	estimate.Records = estimate.SampledRecords
+	estimate.Users = int64(len(users))
+	estimate.FootprintBytes = (perUser + perRecord) * heapGrowthFactor
+	if !estimate.Exact && estimate.SampledBytes > 0 && len(users) > 0 {
+		scale := float64(estimate.FileBytes) / float64(estimate.SampledBytes)
+		estimate.Records = int64(float64(estimate.SampledRecords) * scale)
+		estimate.Users = projectUsers(estimate.SampledRecords, int64(len(users)), estimate.Records)
+		userScale := float64(estimate.Users) / float64(len(users))
+		estimate.FootprintBytes = int64(float64(perUser)*userScale+float64(perRecord)*scale) * heapGrowthFactor
+	}
+
+	return estimate, nil
+}
+
+// projectUsers estimates the users of an input of records from a sample of
+// sampledRecords holding sampledUsers.  Were records drawn evenly from u
+// users, a sample of n records would hold u*(1-e^(-n/u)) of them, which is
+// solved for u.  A sample seeing few users twice gives up to one user per
+// record.  Users who only turn up later in the input are missed, in memory
+// those over the budget are spilled to disk
+func projectUsers(sampledRecords, sampledUsers, records int64) int64 {
+	seen := func(users float64) float64 {
+		return users * (1 - math.Exp(-float64(sampledRecords)/users))
+	}
+	if seen(float64(records)) <= float64(sampledUsers) {
+		return records
+	}
+
+	//seen grows with the users, so bisect between what the sample saw and
+	//one user per record
+	low, high := float64(sampledUsers), float64(records)
+	for high-low > 1 {
+		mid := (low + high) / 2
+		if seen(mid) < float64(sampledUsers) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+
+	return int64(high)
+}
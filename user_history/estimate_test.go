@@ -0,0 +1,48 @@
+package user_history
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProjectUsers(t *testing.T) {
+	tests := []struct {
+		name           string
+		sampledRecords int64
+		sampledUsers   int64
+		records        int64
+		want           int64
+	}{
+		{"every record a new user", 1000, 1000, 100000, 100000},
+		{"users seen again and again", 100000, 100, 1000000, 100},
+		{"a fifth of the sample repeats", 1000, 800, 10000, 2154},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := projectUsers(test.sampledRecords, test.sampledUsers, test.records)
+			//bisection stops within a user of the answer
+			if got < test.want-1 || got > test.want+1 {
+				t.Errorf("projectUsers(%d, %d, %d) = %d, want %d",
+					test.sampledRecords, test.sampledUsers, test.records, got, test.want)
+			}
+		})
+	}
+}
+
+func TestProjectUsersSolvesForTheSample(t *testing.T) {
+	const sampledRecords, records = 5000, 500000
+
+	for _, sampledUsers := range []int64{100, 1000, 3000, 4500} {
+		users := projectUsers(sampledRecords, sampledUsers, records)
+		if users < sampledUsers || users > records {
+			t.Fatalf("projectUsers(%d) = %d, outside [%d, %d]", sampledUsers, users, sampledUsers, records)
+		}
+
+		//a sample drawn from the projected users holds what this one did
+		seen := float64(users) * (1 - math.Exp(-float64(sampledRecords)/float64(users)))
+		if math.Abs(seen-float64(sampledUsers)) > 1 {
+			t.Errorf("projectUsers(%d) = %d, which would show %.1f users", sampledUsers, users, seen)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package user_history
+
+import (
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/storage"
+	"strconv"
+)
+
+// the settings state built by this run must be built with throughout
+func currentIngestSettings() *storage.IngestSettings {
+	settings := &storage.IngestSettings{EventBuckets: global.EventBuckets}
+	for i, aggregation := range EventAggregations() {
+		if i > 0 {
+			settings.EventAggregations += ","
+		}
+		settings.EventAggregations += aggregation.Func + "(" + aggregation.Event + "." + aggregation.Field + ")"
+	}
+	if global.EventBuckets != "" {
+		settings.EventTimezone = global.EventTimezone
+	}
+	if global.AttributeHistory != 0 {
+		settings.AttributeHistory = strconv.Itoa(global.AttributeHistory)
+	}
+	settings.AsOf = global.AsOf
+
+	return settings
+}
+
+// AdoptIngestSettings switches to the settings the state was built with, so
+// state rebuilt or reported outside a run matches the rest of it
+func AdoptIngestSettings() error {
+	settings, err := storage.LoadIngestSettings()
+	if err != nil || settings == nil {
+		return err
+	}
+
+	global.EventBuckets = settings.EventBuckets
+	global.EventTimezone = settings.EventTimezone
+	if global.EventTimezone == "" {
+		global.EventTimezone = "UTC"
+	}
+	global.EventAggregations = settings.EventAggregations
+	global.AsOf = settings.AsOf
+	global.AttributeHistory = 0
+	if settings.AttributeHistory != "" {
+		global.AttributeHistory, err = strconv.Atoi(settings.AttributeHistory)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = CheckEventBuckets()
+	if err != nil {
+		return err
+	}
+
+	return CheckEventAggregations()
+}
+
+// records after global.AsOf don't contribute to the state
+func afterAsOf(timestamp int64) bool {
+	return global.AsOf != 0 && timestamp > global.AsOf
+}
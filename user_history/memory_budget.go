@@ -0,0 +1,184 @@
+package user_history
+
+import (
+	"container/list"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/storage"
+	"log"
+)
+
+// once over budget, users are spilled until the footprint is back down to
+// this share of it, so the next few records don't spill again straight away
+const spillLowWater = 0.75
+
+// residentUsers keeps the users of an in-memory run within
+// global.MemoryBudgetBytes.  Their footprint is approximated the way
+// EstimateInput projects it, and once it is over budget the users touched
+// least recently are spilled to disk, to be read back if they show up again
+// while there is room for them
+type residentUsers struct {
+	users map[int]*models.User
+	// resident users, most recently touched at the front
+	recency  *list.List
+	elements map[int]*list.Element
+	// footprint accounted to each resident user, and their total
+	footprints     map[int]int64
+	footprintBytes int64
+
+	spilled      map[int]struct{}
+	spilledUsers int64
+	budgetLogged bool
+}
+
+func newResidentUsers() *residentUsers {
+	return &residentUsers{
+		users:      map[int]*models.User{},
+		recency:    list.New(),
+		elements:   map[int]*list.Element{},
+		footprints: map[int]int64{},
+		spilled:    map[int]struct{}{},
+	}
+}
+
+// touch marks a resident userId the most recently used, or makes a new one
+// resident.  A spilled user is only read back while it fits under the low
+// water mark, reading it back past it would only spill another user in its
+// place.  Otherwise it is returned, to be updated and spilled again by the
+// caller
+func (r *residentUsers) touch(userId int) (*models.User, error) {
+	if element, ok := r.elements[userId]; ok {
+		r.recency.MoveToFront(element)
+		return nil, nil
+	}
+
+	footprint := int64(userOverheadBytes)
+	if _, ok := r.spilled[userId]; ok {
+		user, err := storage.LoadSpilledUser(userId)
+		if err != nil {
+			return nil, err
+		}
+		footprint = userFootprint(user)
+		if r.footprintBytes+footprint > lowWater() {
+			return user, nil
+		}
+
+		err = storage.RemoveSpilledUser(userId)
+		if err != nil {
+			return nil, err
+		}
+		delete(r.spilled, userId)
+		r.users[userId] = user
+	}
+
+	r.elements[userId] = r.recency.PushFront(userId)
+	r.footprints[userId] = footprint
+	r.footprintBytes += footprint
+
+	return nil, nil
+}
+
+// grow accounts for footprint added to a resident user, spilling cold users
+// when that takes the footprint over budget
+func (r *residentUsers) grow(userId int, footprint int64) error {
+	r.footprints[userId] += footprint
+	r.footprintBytes += footprint
+
+	if r.footprintBytes*heapGrowthFactor <= global.MemoryBudgetBytes {
+		return nil
+	}
+
+	if !r.budgetLogged {
+		log.Printf("memory budget %s reached with %d users in memory, spilling the least recently seen to %s",
+			storage.FormatBytes(global.MemoryBudgetBytes), len(r.users), storage.SpillDirectory())
+		r.budgetLogged = true
+	}
+
+	//the user just added to stays, it is the one most likely to be seen next
+	for r.footprintBytes > lowWater() && r.recency.Len() > 1 {
+		err := r.spill(r.recency.Back().Value.(int))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lowWater is the footprint spilling brings the users back down to
+func lowWater() int64 {
+	return int64(float64(global.MemoryBudgetBytes) * spillLowWater / heapGrowthFactor)
+}
+
+func (r *residentUsers) spill(userId int) error {
+	//a user whose only records were rejected was never created
+	if user, ok := r.users[userId]; ok {
+		err := storage.SpillUser(user)
+		if err != nil {
+			return err
+		}
+		delete(r.users, userId)
+		r.spilled[userId] = struct{}{}
+		r.spilledUsers++
+	}
+
+	r.recency.Remove(r.elements[userId])
+	delete(r.elements, userId)
+	r.footprintBytes -= r.footprints[userId]
+	delete(r.footprints, userId)
+
+	return nil
+}
+
+// userFootprint approximates the memory a user takes
+func userFootprint(user *models.User) int64 {
+	footprint := int64(userOverheadBytes)
+	for name, attribute := range user.Attributes {
+		footprint += attributeOverheadBytes + int64(len(name)+len(attribute.Value))
+		for _, value := range attribute.History {
+			footprint += attributeOverheadBytes + int64(len(value.Value))
+		}
+	}
+	for name, event := range user.Events {
+		footprint += eventOverheadBytes + int64(len(name))
+		for id := range event.Ids {
+			footprint += eventIdOverheadBytes + int64(len(id))
+		}
+	}
+
+	return footprint
+}
+
+// recordFootprint approximates what a record would add to its user, counted
+// before it is added.  Attribute values replaced or kept in history are all
+// counted, which overestimates rather than underestimates
+func (r *residentUsers) recordFootprint(userHistory *models.UserHistory) int64 {
+	user := r.users[userHistory.UserId]
+	var footprint int64
+
+	if userHistory.HistoryType == models.AttributeType {
+		for name, attribute := range userHistory.Attributes {
+			footprint += attributeOverheadBytes + int64(len(attribute.Value))
+			if user == nil || user.Attributes[name] == nil {
+				footprint += int64(len(name))
+			}
+		}
+	} else if userHistory.HistoryType == models.EventType {
+		var event *models.Event
+		if user != nil {
+			event = user.Events[userHistory.Event.Name]
+		}
+		if event == nil {
+			footprint += eventOverheadBytes + int64(len(userHistory.Event.Name))
+		}
+		for id := range userHistory.Event.Ids {
+			if event == nil {
+				footprint += eventIdOverheadBytes + int64(len(id))
+			} else if _, ok := event.Ids[id]; !ok {
+				footprint += eventIdOverheadBytes + int64(len(id))
+			}
+		}
+	}
+
+	return footprint
+}
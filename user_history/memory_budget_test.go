@@ -0,0 +1,130 @@
+package user_history
+
+import (
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/storage"
+	"github.com/customerio/homework/stream"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// budgetTestRecords visits users round and round, so users spilled on one
+// round are seen again on the next
+func budgetTestRecords() []*stream.Record {
+	var records []*stream.Record
+	for round := 0; round < 4; round++ {
+		for userId := 1; userId <= 60; userId++ {
+			timestamp := int64(round*1000 + userId)
+			records = append(records,
+				attributeRecord(userId, "plan", "plan "+strconv.Itoa(round), timestamp),
+				eventRecord(userId, "e"+strconv.Itoa(round)+"-"+strconv.Itoa(userId), "login", timestamp, nil),
+				//seen before, a duplicate
+				eventRecord(userId, "e0-"+strconv.Itoa(userId), "login", timestamp, nil))
+		}
+	}
+
+	return records
+}
+
+// ingestWithinBudget ingests the records in memory within budget, returning
+// every user whether resident or spilled and how many were spilled
+func ingestWithinBudget(t *testing.T, budget int64, records []*stream.Record) (map[int]*models.User, int) {
+	t.Helper()
+
+	useMemory(t)
+	previous := global.MemoryBudgetBytes
+	global.MemoryBudgetBytes = budget
+	t.Cleanup(func() { global.MemoryBudgetBytes = previous })
+
+	users := createTestHistories(t, records...)
+	spilledIds, err := storage.LoadSpilledUserIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userId := range spilledIds {
+		if _, ok := users[userId]; ok {
+			t.Errorf("user %d is both in memory and spilled", userId)
+		}
+		user, err := storage.LoadSpilledUser(userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[userId] = user
+	}
+
+	return users, len(spilledIds)
+}
+
+func TestSpilledUsersMatchUnlimitedMemory(t *testing.T) {
+	want, spilled := ingestWithinBudget(t, 1<<30, budgetTestRecords())
+	if spilled != 0 {
+		t.Fatalf("%d users spilled within an unlimited budget", spilled)
+	}
+
+	got, spilled := ingestWithinBudget(t, 20000, budgetTestRecords())
+	if spilled == 0 {
+		t.Fatalf("no users spilled, the budget is too large for the test")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d users within the budget, want %d", len(got), len(want))
+	}
+	for userId, user := range want {
+		if !reflect.DeepEqual(got[userId], user) {
+			t.Errorf("user %d = %+v within the budget, want %+v", userId, got[userId], user)
+		}
+	}
+}
+
+func TestResidentUsersStayWithinBudget(t *testing.T) {
+	useMemory(t)
+	previous := global.MemoryBudgetBytes
+	global.MemoryBudgetBytes = 20000
+	t.Cleanup(func() { global.MemoryBudgetBytes = previous })
+
+	resident := newResidentUsers()
+	for _, rec := range budgetTestRecords() {
+		userHistory, err := stream.Map(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spilledUser, err := resident.touch(userHistory.UserId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users := resident.users
+		if spilledUser != nil {
+			users = map[int]*models.User{userHistory.UserId: spilledUser}
+		}
+		footprint := resident.recordFootprint(userHistory)
+		updated, err := add(users, userHistory, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spilledUser != nil && updated {
+			err = storage.SpillUser(spilledUser)
+		} else if spilledUser == nil && updated {
+			err = resident.grow(userHistory.UserId, footprint)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resident.footprintBytes*heapGrowthFactor > global.MemoryBudgetBytes {
+			t.Fatalf("footprint %d over the budget after user %d", resident.footprintBytes, userHistory.UserId)
+		}
+	}
+
+	//what the footprint accounts for is what is resident
+	var total int64
+	for userId := range resident.users {
+		total += resident.footprints[userId]
+	}
+	if total > resident.footprintBytes || len(resident.users) != resident.recency.Len() {
+		t.Errorf("%d users, %d in recency, footprints %d of %d",
+			len(resident.users), resident.recency.Len(), total, resident.footprintBytes)
+	}
+}
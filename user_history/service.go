@@ -1,9 +1,13 @@
 package user_history
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/customerio/homework/custom_error"
 	"github.com/customerio/homework/global"
 	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/progress"
 	"github.com/customerio/homework/storage"
 	"github.com/customerio/homework/stream"
 	"log"
@@ -11,19 +15,76 @@ import (
 )
 
 // CreateHistories loop over stream from input file
-// creating list (in memory or on disk) of users and their associated Events and Attributes
-func CreateHistories(recordStream <-chan *stream.Record) (map[int]*models.User, error) {
+// creating list (in memory or on disk) of users and their associated Events and Attributes,
+// counting the records read, rejected and removed as duplicates.  With storage
+// the counts carry on from those of earlier ingests into the state.
+// Once ctx is done the stream ends early, leaving the offset checkpoint to resume from.
+// In memory, users past global.MemoryBudgetBytes are spilled to disk and left
+// out of the users returned, storage.LoadSpilledUserIds lists them
+func CreateHistories(ctx context.Context, recordStream <-chan *stream.Record) (map[int]*models.User, *storage.IngestCounters, error) {
 	var users map[int]*models.User
+	var resident *residentUsers
 	var resumeOffset int64
+	counters := &storage.IngestCounters{}
+
+	//forgotten users must not be recreated from the input
+	tombstones, err := storage.LoadTombstones()
+	if err != nil {
+		return nil, nil, custom_error.New("error loading tombstones", err)
+	}
+
+	//users changed by this ingest are stamped for the next incremental report
+	generations, err := storage.LoadGenerations()
+	if err != nil {
+		return nil, nil, custom_error.New("error loading report generations", err)
+	}
+	generation := generations.NextGeneration()
+
+	//events counted into buckets or aggregated can't be recounted differently,
+	//and records after an as-of time can't be taken back out
+	if global.UseStorage {
+		err = storage.CheckIngestSettings(currentIngestSettings())
+		if err != nil {
+			return nil, nil, custom_error.New("refusing to update state", err)
+		}
+	}
 
 	if global.UseStorage && global.WasInterrupted {
 		if !storage.CheckRecordOffsetExist() {
-			return users, nil
+			//the ingest finished before the interruption
+			counters, err = storage.LoadIngestCounters()
+			return users, counters, err
 		} else {
-			resumeOffset, _ = storage.GetCurrentRecordOffset()
+			resumeOffset, counters, err = storage.GetCurrentRecordOffset()
+			if err != nil {
+				return nil, nil, custom_error.New("error reading ingest checkpoint", err)
+			}
 		}
-	} else {
+	} else if global.UseStorage {
 		users = map[int]*models.User{}
+		//the state holds users of every input ingested into it, so do its
+		//counters
+		counters, err = storage.LoadIngestCounters()
+		if err != nil {
+			return nil, nil, custom_error.New("error loading ingest counters", err)
+		}
+	} else {
+		//users spilled by an earlier run that didn't finish are stale
+		err = storage.ClearSpill()
+		if err != nil {
+			return nil, nil, custom_error.New("error clearing spilled users", err)
+		}
+		resident = newResidentUsers()
+		users = resident.users
+	}
+
+	//users in state from earlier inputs, or from before the interruption,
+	//count towards the users of the ingest
+	if global.UseStorage && global.ProgressInterval > 0 {
+		userIds, err := storage.LoadAllUserIds()
+		if err == nil {
+			progress.StateUsers(len(userIds))
+		}
 	}
 
 	for rec := range recordStream {
@@ -31,37 +92,101 @@ func CreateHistories(recordStream <-chan *stream.Record) (map[int]*models.User,
 		if global.UseStorage && (resumeOffset > rec.Position) {
 			continue
 		} else if global.UseStorage {
-			_ = storage.SetCurrentRecordOffset(rec.Position)
+			_ = storage.SetCurrentRecordOffset(rec.Position, counters)
+		}
+		counters.Records++
+		progress.Ingested(rec.Position, counters)
+
+		if rec.Err != nil {
+			log.Println("json.Unmarshal failed", rec.Err)
+			counters.Rejected++
+			continue
 		}
 
 		userId, _ := strconv.Atoi(rec.UserID)
+		if _, ok := tombstones[userId]; ok || afterAsOf(rec.Timestamp) {
+			continue
+		}
+
 		userHistory, err := stream.Map(rec)
 		if err != nil {
 			log.Println(custom_error.New("error mapping record from stream", err))
+			counters.Rejected++
 			continue
 		}
 
 		if global.UseStorage {
 			user, err := storage.LoadUserState(userId)
-			if err != nil {
-				log.Println(custom_error.New("error loading state for userId: "+rec.UserID, err))
+			if errors.Is(err, storage.ErrFutureStateVersion) {
+				return nil, nil, custom_error.New("refusing to update state for userId: "+rec.UserID, err)
+			} else if err != nil {
+				//the user is rebuilt from the input by fsck, skipping is safe
+				log.Println(custom_error.New("error loading state for userId: "+rec.UserID+", run fsck to repair", err))
 				continue
 			}
 			users = map[int]*models.User{}
 			users[userId] = user
 		}
 
+		var footprint int64
+		spilled := false
+		if resident != nil {
+			spilledUser, err := resident.touch(userId)
+			if err != nil {
+				return nil, nil, custom_error.New("error reading back spilled userId: "+rec.UserID, err)
+			}
+			//a user left spilled is updated on disk
+			users = resident.users
+			spilled = spilledUser != nil
+			if spilled {
+				users = map[int]*models.User{userId: spilledUser}
+			} else {
+				footprint = resident.recordFootprint(userHistory)
+			}
+		}
+
+		//users new to the state have nothing in it yet
+		user := users[userId]
+		isNew := user == nil || (len(user.Attributes) == 0 && len(user.Events) == 0)
+
 		//populate user with event/attr info
-		err = add(users, userHistory)
+		updated, err := add(users, userHistory, generation)
 		if err != nil {
 			log.Println(custom_error.New("error adding userHistory", err))
+			counters.Rejected++
 			continue
 		}
+		//only an event already counted leaves an event record without effect,
+		//unless it is the record a resumed ingest stopped at, which may have
+		//been saved before the interruption
+		replayed := global.UseStorage && rec.Position == resumeOffset
+		if userHistory.HistoryType == models.EventType && !updated && !replayed {
+			counters.Duplicates++
+		}
+		if isNew && updated {
+			progress.NewUser()
+		}
 
-		//save user to storage
-		if global.UseStorage {
-			err = storage.SaveUserState(users[userId])
+		if spilled && updated {
+			err = storage.SpillUser(users[userId])
 			if err != nil {
+				return nil, nil, custom_error.New("error updating spilled userId: "+rec.UserID, err)
+			}
+		} else if resident != nil && updated {
+			err = resident.grow(userId, footprint)
+			if err != nil {
+				return nil, nil, custom_error.New("error spilling users over the memory budget", err)
+			}
+		}
+
+		//save user to storage, duplicates and stale attributes change nothing
+		if global.UseStorage && updated {
+			err = storage.SaveUserState(users[userId])
+			if errors.Is(err, storage.ErrDiskBudgetExceeded) {
+				//leave the offset checkpoint in place so the run can be resumed
+				//once space has been freed
+				return nil, nil, custom_error.New("stopping at offset "+strconv.FormatInt(rec.Position, 10), err)
+			} else if err != nil {
 				msg := "error saving user state to storage for userId: " + rec.UserID
 				log.Println(custom_error.New(msg, err))
 				continue
@@ -69,16 +194,34 @@ func CreateHistories(recordStream <-chan *stream.Record) (map[int]*models.User,
 		}
 	}
 
+	//the stream was cut short, the input isn't fully ingested
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
 	if global.UseStorage {
+		err = storage.SaveIngestCounters(counters)
+		if err != nil {
+			return nil, nil, custom_error.New("error saving ingest counters", err)
+		}
 		storage.RemoveOffsetFile()
 	}
+	if resident != nil {
+		users = resident.users
+	}
+	if resident != nil && resident.spilledUsers > 0 {
+		log.Printf("%d users in memory, %d spilled to disk (%d spills)",
+			len(resident.users), len(resident.spilled), resident.spilledUsers)
+	}
 
-	return users, nil
+	return users, counters, nil
 }
 
 // Dedupe Users
-// populate user with history data
-func add(users map[int]*models.User, userHistory *models.UserHistory) error {
+// populate user with history data, returning whether the user was updated.
+// Users whose report output changed are stamped with generation, as are
+// users whose first seen, last seen or set_at timestamps moved
+func add(users map[int]*models.User, userHistory *models.UserHistory, generation int) (bool, error) {
 	//create user if it is first time encountering this userId
 	user, ok := users[userHistory.UserId]
 	if !ok {
@@ -89,48 +232,229 @@ func add(users map[int]*models.User, userHistory *models.UserHistory) error {
 		}
 		users[userHistory.UserId] = user
 	}
+	isNew := len(user.Attributes) == 0 && len(user.Events) == 0
 
 	//we have different parsing for Events and Attributes, handle accordingly
+	var updated, seenMoved, changed bool
 	if userHistory.HistoryType == models.AttributeType {
-		addAttributes(user.Attributes, userHistory.Attributes)
+		updated, seenMoved, changed = addAttributes(user.Attributes, userHistory.Attributes)
 	} else if userHistory.HistoryType == models.EventType {
-		addEvent(user.Events, userHistory.Event)
+		changed = addEvent(
+			user.Events, userHistory.Event, eventBucket(userHistory.Timestamp), aggregatedValues(userHistory))
+		updated = changed
 	} else { //Should never happen
-		return custom_error.New("Unknown HistoryType userId: "+strconv.Itoa(user.ID), nil).Log()
+		return false, custom_error.New("Unknown HistoryType userId: "+strconv.Itoa(user.ID), nil).Log()
 	}
 
-	return nil
+	//records arrive out of order, only the extremes are kept.  Duplicate
+	//events were already seen
+	isDuplicate := userHistory.HistoryType == models.EventType && !changed
+	if !isDuplicate && widenSeen(&user.FirstSeen, &user.LastSeen, userHistory.Timestamp) {
+		updated = true
+		seenMoved = true
+	}
+
+	if seenMoved {
+		user.SeenGeneration = generation
+	}
+	if changed {
+		user.ModifiedGeneration = generation
+		if isNew {
+			user.CreatedGeneration = generation
+		}
+	}
+
+	return updated, nil
 }
 
-// decorate user attributes
-func addAttributes(userAttrs map[string]*models.Attribute, historyAttrs map[string]*models.Attribute) {
+// decorate user attributes, a newer timestamp updates the attribute and
+// moves when it was set but only a different value changes it.  Kept history
+// takes every value, in or out of order, and updates the attribute too
+func addAttributes(
+	userAttrs map[string]*models.Attribute,
+	historyAttrs map[string]*models.Attribute) (updated, setAtMoved, changed bool) {
+
 	for historyKey, historyElement := range historyAttrs {
 		userAttrElement, ok := userAttrs[historyKey]
 
 		//if we have not encountered this attribute type yet,
 		// or we have, but this timestamp is the most recent for that type
 		if !ok || (historyElement.Timestamp > userAttrElement.Timestamp) {
+			if ok {
+				historyElement.History = userAttrElement.History
+			}
 			userAttrs[historyKey] = historyElement
+			updated = true
+			setAtMoved = true
+			changed = changed || !ok || historyElement.Value != userAttrElement.Value
+		}
+
+		if addToHistory(userAttrs[historyKey], historyElement.Timestamp, historyElement.Value) {
+			updated = true
 		}
 	}
+
+	return updated, setAtMoved, changed
 }
 
-func addEvent(userEvents map[string]*models.Event, historyEvent *models.Event) {
+// counts an event once per id, in its total, in the bucket it falls in when
+// events are bucketed and in the aggregates of its numeric data fields
+func addEvent(
+	userEvents map[string]*models.Event,
+	historyEvent *models.Event,
+	bucket string,
+	values map[string]float64) bool {
+
 	userEvent, ok := userEvents[historyEvent.Name]
 	//first time we are encountering this event type
 	if !ok {
 		userEvents[historyEvent.Name] = historyEvent
+		addToBucket(historyEvent, bucket, historyEvent.NumOccurrances)
+		addToAggregates(historyEvent, values)
+		return true
 
 	} else {
 		//handle duplicate event ids
 		for id := range historyEvent.Ids {
 			_, ok := userEvent.Ids[id]
 			if ok { //duplicate event
-				return
+				return false
 			} else { //not a duplicate event id, but we have seen this event type before
 				userEvent.Ids[id] = struct{}{}
 				userEvent.NumOccurrances++
+				addToBucket(userEvent, bucket, 1)
+				addToAggregates(userEvent, values)
+				widenSeen(&userEvent.FirstSeen, &userEvent.LastSeen, historyEvent.FirstSeen)
 			}
 		}
 	}
+
+	return true
+}
+
+// widenSeen moves first and last out to include timestamp, returning whether
+// either moved.  0 is unset, as in state from before they were tracked
+func widenSeen(first, last *int64, timestamp int64) bool {
+	moved := false
+	if *first == 0 || timestamp < *first {
+		*first = timestamp
+		moved = true
+	}
+	if timestamp > *last {
+		*last = timestamp
+		moved = true
+	}
+
+	return moved
+}
+
+func addToBucket(event *models.Event, bucket string, occurrences int) {
+	if bucket == "" {
+		return
+	}
+	if event.Buckets == nil {
+		event.Buckets = map[string]int{}
+	}
+	event.Buckets[bucket] += occurrences
+}
+
+// ErrSeveralInputs refuses to rebuild users from one input of state that was
+// built from more
+var ErrSeveralInputs = errors.New("state was built from more than one input")
+
+// RebuildUsers replays the record stream for only the given users, replacing
+// whatever state they had.  When an ingest is in progress only records before
+// its checkpoint are replayed, the resumed ingest applies the rest.  State
+// built from several inputs is only rebuilt from this one when forced, the
+// users lose whatever the other inputs added
+func RebuildUsers(recordStream <-chan *stream.Record, userIds []int, force bool) (int, error) {
+	var stopOffset int64 = -1
+	if storage.CheckRecordOffsetExist() {
+		offset, _, err := storage.GetCurrentRecordOffset()
+		if err != nil {
+			return 0, custom_error.New("error reading ingest checkpoint", err)
+		}
+		stopOffset = offset
+	}
+
+	tombstones, err := storage.LoadTombstones()
+	if err != nil {
+		return 0, custom_error.New("error loading tombstones", err)
+	}
+
+	err = AdoptIngestSettings()
+	if err != nil {
+		return 0, custom_error.New("error loading ingest settings", err)
+	}
+
+	//rebuilt users count as changed for the next incremental report
+	generations, err := storage.LoadGenerations()
+	if err != nil {
+		return 0, custom_error.New("error loading report generations", err)
+	}
+
+	//every report completes the ingest of one input, an interrupted ingest
+	//is one more
+	inputs := generations.LastGeneration
+	if stopOffset >= 0 {
+		inputs++
+	}
+	if inputs > 1 {
+		msg := fmt.Sprintf("state holds %d ingested inputs, rebuilding from one of them loses what the others added", inputs)
+		if !force {
+			return 0, custom_error.New(msg+", use -force to rebuild anyway", ErrSeveralInputs)
+		}
+		log.Println("warning: " + msg)
+	}
+
+	wanted := map[int]struct{}{}
+	for _, userId := range userIds {
+		if _, ok := tombstones[userId]; !ok {
+			wanted[userId] = struct{}{}
+		}
+	}
+
+	users := map[int]*models.User{}
+	for rec := range recordStream {
+		if rec.Err != nil || (stopOffset >= 0 && rec.Position >= stopOffset) || afterAsOf(rec.Timestamp) {
+			continue
+		}
+
+		userId, err := strconv.Atoi(rec.UserID)
+		if err != nil {
+			continue
+		}
+		if _, ok := wanted[userId]; !ok {
+			continue
+		}
+
+		userHistory, err := stream.Map(rec)
+		if err != nil {
+			log.Println(custom_error.New("error mapping record from stream", err))
+			continue
+		}
+
+		_, err = add(users, userHistory, generations.NextGeneration())
+		if err != nil {
+			log.Println(custom_error.New("error adding userHistory", err))
+		}
+	}
+
+	for _, userId := range userIds {
+		err := storage.RemoveUserState(userId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, user := range users {
+		//when they were created is lost with their state
+		user.CreatedGeneration = 0
+		err := storage.SaveUserState(user)
+		if err != nil {
+			return 0, custom_error.New("error saving rebuilt state for userId: "+strconv.Itoa(user.ID), err)
+		}
+	}
+
+	return len(users), nil
 }
@@ -0,0 +1,257 @@
+package user_history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/customerio/homework/global"
+	"github.com/customerio/homework/models"
+	"github.com/customerio/homework/storage"
+	"github.com/customerio/homework/stream"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// useWorkingDirectory runs the test in a fresh temporary directory, so the
+// tombstones and audit log under data/ are its own
+func useWorkingDirectory(t *testing.T) {
+	t.Helper()
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(previous) })
+}
+
+// useStorage keeps user state in a fresh temporary directory for the length
+// of the test
+func useStorage(t *testing.T) {
+	t.Helper()
+
+	useWorkingDirectory(t)
+	previousDirectory := storage.StateDirectory()
+	storage.SetStateDirectory(t.TempDir())
+	global.UseStorage = true
+	t.Cleanup(func() {
+		storage.SetStateDirectory(previousDirectory)
+		global.UseStorage = false
+		global.WasInterrupted = false
+	})
+}
+
+// useMemory keeps users in memory, spilling to a fresh temporary directory,
+// for the length of the test
+func useMemory(t *testing.T) {
+	t.Helper()
+
+	useWorkingDirectory(t)
+	previousSpill := storage.SpillDirectory()
+	previousDirectory := storage.StateDirectory()
+	storage.SetSpillDirectory(filepath.Join(t.TempDir(), "spill"))
+	storage.SetStateDirectory(t.TempDir())
+	global.UseStorage = false
+	t.Cleanup(func() {
+		storage.SetSpillDirectory(previousSpill)
+		storage.SetStateDirectory(previousDirectory)
+	})
+}
+
+func attributeRecord(userId int, name, value string, timestamp int64) *stream.Record {
+	raw, _ := json.Marshal(value)
+	return &stream.Record{
+		ID:        "a" + strconv.FormatInt(timestamp, 10),
+		Type:      stream.Attributes,
+		UserID:    strconv.Itoa(userId),
+		Data:      map[string]json.RawMessage{name: raw},
+		Timestamp: timestamp,
+	}
+}
+
+func eventRecord(userId int, id, name string, timestamp int64, data map[string]string) *stream.Record {
+	rec := &stream.Record{
+		ID:        id,
+		Type:      stream.Event,
+		Name:      name,
+		UserID:    strconv.Itoa(userId),
+		Data:      map[string]json.RawMessage{},
+		Timestamp: timestamp,
+	}
+	for key, value := range data {
+		rec.Data[key] = json.RawMessage(value)
+	}
+
+	return rec
+}
+
+// recordStream sends records as read from an input with one record per 100
+// bytes
+func recordStream(records ...*stream.Record) <-chan *stream.Record {
+	ch := make(chan *stream.Record, len(records))
+	for i, rec := range records {
+		rec.Position = int64(i+1) * 100
+		ch <- rec
+	}
+	close(ch)
+
+	return ch
+}
+
+func createTestHistories(t *testing.T, records ...*stream.Record) map[int]*models.User {
+	t.Helper()
+
+	users, _, err := CreateHistories(context.Background(), recordStream(records...))
+	if err != nil {
+		t.Fatalf("CreateHistories: %v", err)
+	}
+
+	return users
+}
+
+func TestCreateHistoriesSkipsForgottenUsers(t *testing.T) {
+	useStorage(t)
+
+	createTestHistories(t,
+		attributeRecord(1, "email", "one@b.com", 10),
+		attributeRecord(2, "email", "two@b.com", 20))
+
+	_, err := storage.ForgetUser(2)
+	if err != nil {
+		t.Fatalf("ForgetUser: %v", err)
+	}
+
+	//the run is resumed from a checkpoint taken before user 2 was forgotten,
+	//user 4 comes before it and was already ingested
+	err = storage.SetCurrentRecordOffset(200, &storage.IngestCounters{Records: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.WasInterrupted = true
+	createTestHistories(t,
+		attributeRecord(4, "email", "four@b.com", 5),
+		attributeRecord(2, "email", "two@b.com", 20),
+		eventRecord(2, "e1", "purchase", 30, nil),
+		attributeRecord(3, "email", "three@b.com", 40))
+
+	userIds, err := storage.LoadAllUserIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(userIds, []int{1, 3}) {
+		t.Errorf("users after resuming = %v, want [1 3]", userIds)
+	}
+}
+
+func TestCreateHistoriesAsOf(t *testing.T) {
+	useMemory(t)
+	previous := global.AsOf
+	global.AsOf = 100
+	t.Cleanup(func() { global.AsOf = previous })
+
+	users := createTestHistories(t,
+		attributeRecord(1, "email", "old@b.com", 50),
+		attributeRecord(1, "email", "new@b.com", 150),
+		eventRecord(1, "e1", "purchase", 100, nil),
+		eventRecord(1, "e2", "purchase", 101, nil),
+		attributeRecord(2, "email", "later@b.com", 200),
+	)
+
+	if _, ok := users[2]; ok {
+		t.Errorf("user only seen after the cutoff was created")
+	}
+	user := users[1]
+	if user == nil {
+		t.Fatalf("user 1 missing")
+	}
+	if got := user.Attributes["email"].Value; got != "old@b.com" {
+		t.Errorf("email = %q, want the value set before the cutoff", got)
+	}
+	if got := user.Events["purchase"].NumOccurrances; got != 1 {
+		t.Errorf("purchase = %d, want only the event at the cutoff", got)
+	}
+	if user.LastSeen != 100 {
+		t.Errorf("LastSeen = %d, want 100", user.LastSeen)
+	}
+}
+
+func TestRebuildUsersFromSeveralInputs(t *testing.T) {
+	useStorage(t)
+
+	records := func() <-chan *stream.Record {
+		return recordStream(
+			attributeRecord(1, "email", "one@b.com", 10),
+			attributeRecord(2, "email", "two@b.com", 20))
+	}
+
+	//one report, the state holds a single input
+	_, err := storage.CompleteFullReport("data/output.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt, err := RebuildUsers(records(), []int{1}, false); err != nil || rebuilt != 1 {
+		t.Fatalf("RebuildUsers of a single input = %d, %v", rebuilt, err)
+	}
+
+	//an ingest of a second input is in progress
+	err = storage.SetCurrentRecordOffset(100, &storage.IngestCounters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RebuildUsers(records(), []int{1}, false)
+	if !errors.Is(err, ErrSeveralInputs) {
+		t.Errorf("err = %v, want ErrSeveralInputs", err)
+	}
+	storage.RemoveOffsetFile()
+
+	_, err = storage.CompleteFullReport("data/output.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RebuildUsers(records(), []int{1}, false)
+	if !errors.Is(err, ErrSeveralInputs) {
+		t.Errorf("err = %v, want ErrSeveralInputs", err)
+	}
+	if rebuilt, err := RebuildUsers(records(), []int{1, 2}, true); err != nil || rebuilt != 2 {
+		t.Errorf("forced RebuildUsers = %d, %v", rebuilt, err)
+	}
+}
+
+func TestIngestCountersCoverEveryInput(t *testing.T) {
+	useStorage(t)
+
+	ingest := func(records ...*stream.Record) storage.IngestCounters {
+		t.Helper()
+		_, counters, err := CreateHistories(context.Background(), recordStream(records...))
+		if err != nil {
+			t.Fatalf("CreateHistories: %v", err)
+		}
+		return *counters
+	}
+
+	ingest(
+		eventRecord(1, "e1", "purchase", 10, nil),
+		eventRecord(1, "e1", "purchase", 10, nil))
+	got := ingest(attributeRecord(2, "email", "two@b.com", 20))
+	if want := (storage.IngestCounters{Records: 3, Duplicates: 1}); got != want {
+		t.Errorf("counters after a second input = %+v, want %+v", got, want)
+	}
+
+	//stopped at the second record of a third input after saving it
+	ingest(eventRecord(3, "e3", "purchase", 30, nil), eventRecord(3, "e4", "purchase", 40, nil))
+	err := storage.SetCurrentRecordOffset(200, &storage.IngestCounters{Records: 4, Duplicates: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.WasInterrupted = true
+	got = ingest(eventRecord(3, "e3", "purchase", 30, nil), eventRecord(3, "e4", "purchase", 40, nil))
+	if want := (storage.IngestCounters{Records: 5, Duplicates: 1}); got != want {
+		t.Errorf("counters after resuming = %+v, want %+v, the replayed record isn't a duplicate", got, want)
+	}
+}
@@ -19,6 +19,31 @@ func SortUserIds(users map[int]*models.User) []int {
 	return sorted
 }
 
+// MergeUserIds merges two sorted lists of user ids into one, an id in both
+// appears once
+func MergeUserIds(a, b []int) []int {
+	merged := make([]int, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			merged = append(merged, a[i])
+			i++
+		case b[j] < a[i]:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, a[i])
+			i++
+			j++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	merged = append(merged, b[j:]...)
+
+	return merged
+}
+
 func SortAttributes(attributes map[string]*models.Attribute) []string {
 	sorted := make([]string, len(attributes))
 